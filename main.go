@@ -1,158 +1,3118 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/bits"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// settings holds the server configuration. Fields are filled from the
+// command-line flags and some can be changed at runtime with CONFIG SET.
+type settings struct {
+	port      int
+	bind      string
+	aclFile   string
+	accessLog string
+	httpAddr  string
+
+	// dumpDir is the only directory DUMPALL and IMPORT may write and read
+	// files in. Empty disables file dumps.
+	dumpDir string
+
+	// maxValue is the largest value, in bytes, a write may store. Zero
+	// disables the limit.
+	maxValue int
+	// maxKeyLen is the longest key, in bytes, a write may create. Zero
+	// disables the limit.
+	maxKeyLen int
+
+	caseInsensitiveKeys bool
+
+	// tcpKeepAlive is the keepalive period in seconds set on accepted
+	// connections. Zero turns keepalive off.
+	tcpKeepAlive int
+	// tcpNoDelay disables Nagle's algorithm on accepted connections so
+	// small replies go out immediately.
+	tcpNoDelay bool
+
+	// lockWatchdog is how long, in milliseconds, the write lock may be
+	// held before a warning is logged. Zero disables the watchdog.
+	lockWatchdog int
+
+	// idleTimeout is how long, in seconds, a connection may wait between
+	// requests before it is closed. Zero keeps idle connections open.
+	idleTimeout int
+
+	// maxCmdsPerSec is how many commands per second a connection may
+	// send before further ones are rejected. Zero disables the limit.
+	maxCmdsPerSec int
+
+	// commandTimeout is how long, in milliseconds, a heavy read (LPOS,
+	// BITCOUNT, BITPOS or DUMPALL) may run before it is aborted. Zero disables the limit.
+	commandTimeout int
+}
+
+// config guards the live settings. Readers take a copy with current, so
+// a command sees one consistent set of values even if CONFIG SET runs
+// concurrently.
+type config struct {
+	mu sync.RWMutex
+	s  settings
+}
+
+func (cfg *config) current() settings {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.s
+}
+
+// configParam is a parameter known to CONFIG GET and the config file.
+// Fixed parameters can only be set at startup and are rejected by
+// CONFIG SET.
+type configParam struct {
+	name  string
+	fixed bool
+	get   func(*settings) string
+	set   func(*settings, string) error
+}
+
+// configParams lists every parameter in the order CONFIG GET * reports
+// them. Names match the command-line flags.
+var configParams = []configParam{
+	{
+		name:  "port",
+		fixed: true,
+		get:   func(s *settings) string { return strconv.Itoa(s.port) },
+		set:   func(s *settings, v string) error { return setNonNegative(&s.port, v) },
+	},
+	{
+		name:  "bind",
+		fixed: true,
+		get:   func(s *settings) string { return s.bind },
+		set:   func(s *settings, v string) error { s.bind = v; return nil },
+	},
+	{
+		name:  "acl-file",
+		fixed: true,
+		get:   func(s *settings) string { return s.aclFile },
+		set:   func(s *settings, v string) error { s.aclFile = v; return nil },
+	},
+	{
+		name:  "accesslog",
+		fixed: true,
+		get:   func(s *settings) string { return s.accessLog },
+		set:   func(s *settings, v string) error { s.accessLog = v; return nil },
+	},
+	{
+		name:  "http-addr",
+		fixed: true,
+		get:   func(s *settings) string { return s.httpAddr },
+		set:   func(s *settings, v string) error { s.httpAddr = v; return nil },
+	},
+	{
+		name:  "dump-dir",
+		fixed: true,
+		get:   func(s *settings) string { return s.dumpDir },
+		set:   func(s *settings, v string) error { s.dumpDir = v; return nil },
+	},
+	{
+		name: "maxvalue",
+		get:  func(s *settings) string { return strconv.Itoa(s.maxValue) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.maxValue, v) },
+	},
+	{
+		name: "maxkeylen",
+		get:  func(s *settings) string { return strconv.Itoa(s.maxKeyLen) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.maxKeyLen, v) },
+	},
+	// Changing key case folding at runtime would strand keys already
+	// stored under the other rule, so it stays fixed.
+	{
+		name:  "case-insensitive-keys",
+		fixed: true,
+		get:   func(s *settings) string { return formatBool(s.caseInsensitiveKeys) },
+		set:   func(s *settings, v string) error { return setBool(&s.caseInsensitiveKeys, v) },
+	},
+	{
+		name: "tcp-keepalive",
+		get:  func(s *settings) string { return strconv.Itoa(s.tcpKeepAlive) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.tcpKeepAlive, v) },
+	},
+	{
+		name: "tcp-nodelay",
+		get:  func(s *settings) string { return formatBool(s.tcpNoDelay) },
+		set:  func(s *settings, v string) error { return setBool(&s.tcpNoDelay, v) },
+	},
+	{
+		name: "command-timeout",
+		get:  func(s *settings) string { return strconv.Itoa(s.commandTimeout) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.commandTimeout, v) },
+	},
+	{
+		name: "idle-timeout",
+		get:  func(s *settings) string { return strconv.Itoa(s.idleTimeout) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.idleTimeout, v) },
+	},
+	{
+		name: "maxcmds-per-sec",
+		get:  func(s *settings) string { return strconv.Itoa(s.maxCmdsPerSec) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.maxCmdsPerSec, v) },
+	},
+	{
+		name: "lock-watchdog-ms",
+		get:  func(s *settings) string { return strconv.Itoa(s.lockWatchdog) },
+		set:  func(s *settings, v string) error { return setNonNegative(&s.lockWatchdog, v) },
+	},
+}
+
+func findConfigParam(name string) (configParam, bool) {
+	for _, param := range configParams {
+		if strings.EqualFold(name, param.name) {
+			return param, true
+		}
+	}
+	return configParam{}, false
+}
+
+// loadConfigFile applies a config file of "name value" lines to s.
+// Blank lines and lines starting with '#' are skipped, which also makes
+// files written by CONFIG REWRITE loadable.
+func loadConfigFile(path string, s *settings) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"name value\"", path, lineNo)
+		}
+		param, ok := findConfigParam(fields[0])
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown parameter %q", path, lineNo, fields[0])
+		}
+		if err := param.set(s, fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", path, lineNo, param.name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// formatBool renders a boolean parameter the way Redis does.
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func setBool(dst *bool, v string) error {
+	switch strings.ToLower(v) {
+	case "yes":
+		*dst = true
+	case "no":
+		*dst = false
+	default:
+		return fmt.Errorf("argument must be 'yes' or 'no'")
+	}
+	return nil
+}
+
+func setNonNegative(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("argument must be a non-negative integer")
+	}
+	*dst = n
+	return nil
+}
+
+// get returns "name value" pairs for every parameter matching name, or
+// every parameter for "*".
+func (cfg *config) get(name string) [][2]string {
+	s := cfg.current()
+	var pairs [][2]string
+	for _, param := range configParams {
+		if name == "*" || strings.EqualFold(name, param.name) {
+			pairs = append(pairs, [2]string{param.name, param.get(&s)})
+		}
+	}
+	return pairs
+}
+
+// set changes a runtime parameter. The new value applies to commands
+// and connections from then on.
+func (cfg *config) set(name, value string) error {
+	param, ok := findConfigParam(name)
+	if !ok {
+		return &commandError{"ERR", fmt.Sprintf("Unsupported CONFIG parameter: %s", name)}
+	}
+	if param.fixed {
+		return &commandError{"ERR", fmt.Sprintf("CONFIG SET failed - '%s' can't be changed at runtime", param.name)}
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if err := param.set(&cfg.s, value); err != nil {
+		return &commandError{"ERR", fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - %s", param.name, err)}
+	}
+	return nil
+}
+
+// rewrite writes every parameter with a value to path as "name value"
+// lines, replacing the file in one rename so it is never left half
+// written.
+func (cfg *config) rewrite(path string) error {
+	var b strings.Builder
+	b.WriteString("# Written by CONFIG REWRITE\n")
+	for _, pair := range cfg.get("*") {
+		if pair[1] == "" {
+			continue
+		}
+		b.WriteString(pair[0] + " " + pair[1] + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// version is the server version reported by LOLWUT/VERSION.
+const version = "0.1.0"
+
+// watchedMutex is a sync.RWMutex that logs a warning when its write lock
+// is held for longer than watchdog returns, naming the function that
+// took it. A nil watchdog, or one returning zero, turns this off.
+type watchedMutex struct {
+	sync.RWMutex
+	watchdog func() time.Duration
+
+	// acquired and holder describe the current write lock holder. They
+	// are only touched while the write lock is held.
+	acquired time.Time
+	holder   string
+}
+
+func (m *watchedMutex) Lock() {
+	m.RWMutex.Lock()
+	if m.watchdog != nil && m.watchdog() > 0 {
+		m.acquired = time.Now()
+		m.holder = "unknown"
+		if pc, _, _, ok := runtime.Caller(1); ok {
+			// Drop the package path: main.(*Redis).set becomes (*Redis).set.
+			name := runtime.FuncForPC(pc).Name()
+			name = name[strings.LastIndex(name, "/")+1:]
+			m.holder = name[strings.Index(name, ".")+1:]
+		}
+	}
+}
+
+func (m *watchedMutex) Unlock() {
+	if m.acquired.IsZero() {
+		m.RWMutex.Unlock()
+		return
+	}
+	held, holder := time.Since(m.acquired), m.holder
+	m.acquired = time.Time{}
+	m.RWMutex.Unlock()
+	if threshold := m.watchdog(); threshold > 0 && held > threshold {
+		log.Printf("WARNING: %s held the write lock for %s (lock-watchdog-ms is %d)\n", holder, held, threshold.Milliseconds())
+	}
+}
+
+// clientConn is a connection in the client registry.
+type clientConn struct {
+	conn net.Conn
+	// idleSince is when the connection started waiting for its next
+	// request, in Unix nanoseconds, or zero while it is running one.
+	idleSince atomic.Int64
+}
+
 type Redis struct {
-	db map[string][]string
+	// mu guards db. Commands that read and then modify a key hold it for
+	// the whole operation so they are atomic with respect to each other.
+	mu  watchedMutex
+	db  map[string][]string
+	acl accessList
+
+	// waiters holds, per key, the channels of BLPOP/BRPOP calls blocked
+	// on it. Guarded by mu.
+	waiters map[string][]chan struct{}
+
+	config config
+	// configFile is where CONFIG REWRITE saves the configuration; empty
+	// when the server was started without -config.
+	configFile string
+
+	// accessLog records every parsed command when -accesslog is set.
+	accessLog *log.Logger
+
+	// listeners counts the listeners currently accepting connections.
+	listeners atomic.Int32
+
+	// lastClientID is the ID handed to the most recent connection.
+	lastClientID atomic.Int64
+
+	// clients holds every open connection by client ID, for the idle
+	// connection reaper. Guarded by clientsMu.
+	clientsMu sync.Mutex
+	clients   map[int64]*clientConn
+
+	stats commandStats
+
+	// now is the server's clock, time.Now outside of tests. TIME, the
+	// -command-timeout deadline and command timings read it so a test
+	// can substitute a clock it controls. The lock watchdog keeps the
+	// real clock since it measures actual stalls.
+	now func() time.Time
+}
+
+// commandStats accumulates, per command name, how many times it ran and
+// for how long in total. It is safe for concurrent use.
+type commandStats struct {
+	mu       sync.Mutex
+	commands map[string]*commandStat
+}
+
+type commandStat struct {
+	calls int64
+	usec  int64
+}
+
+func (s *commandStats) record(command string, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commands == nil {
+		s.commands = make(map[string]*commandStat)
+	}
+	stat, ok := s.commands[command]
+	if !ok {
+		stat = &commandStat{}
+		s.commands[command] = stat
+	}
+	stat.calls++
+	stat.usec += took.Microseconds()
+}
+
+// lines renders the stats as INFO commandstats lines sorted by command.
+func (s *commandStats) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for command, stat := range s.commands {
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f",
+			strings.ToLower(command), stat.calls, stat.usec, float64(stat.usec)/float64(stat.calls)))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// info renders the INFO reply for section, or for every section when
+// section is empty, "all" or "everything".
+func (c *Redis) info(section string) string {
+	section = strings.ToLower(section)
+	all := section == "" || section == "all" || section == "everything"
+
+	var b strings.Builder
+	if all || section == "commandstats" {
+		b.WriteString("# Commandstats\n")
+		for _, line := range c.stats.lines() {
+			b.WriteString(line + "\n")
+		}
+	}
+	if all || section == "keyspace" {
+		// There is a single database and keys never expire. Like Redis,
+		// an empty database gets no line.
+		b.WriteString("# Keyspace\n")
+		if keys := c.dbSize(); keys > 0 {
+			b.WriteString(fmt.Sprintf("db0:keys=%d,expires=0\n", keys))
+		}
+	}
+	return b.String()
+}
+
+// dbSize returns the number of keys.
+func (c *Redis) dbSize() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.db)
+}
+
+// normalizeKey maps key to the form it is stored under. Every access to
+// c.db goes through it so -case-insensitive-keys applies everywhere.
+func (c *Redis) normalizeKey(key string) string {
+	if c.config.current().caseInsensitiveKeys {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// sharedIntegersCount is how many small non-negative integers have a
+// shared value, mirroring Redis's shared integer objects.
+const sharedIntegersCount = 10000
+
+// sharedRefcount is what OBJECT REFCOUNT reports for a shared value,
+// matching the refcount Redis gives its shared objects.
+const sharedRefcount = 2147483647
+
+// sharedIntegers[n] is the value stored for every key SET to n, so many
+// keys holding the same small integer don't each keep their own copy.
+// Values are never modified in place, which makes sharing them safe.
+var sharedIntegers = func() [][]string {
+	shared := make([][]string, sharedIntegersCount)
+	for n := range shared {
+		shared[n] = []string{strconv.Itoa(n)}
+	}
+	return shared
+}()
+
+// sharedInteger returns the shared value for value if it is a single
+// small integer written in canonical form.
+func sharedInteger(value []string) ([]string, bool) {
+	if len(value) != 1 {
+		return nil, false
+	}
+	n, err := strconv.Atoi(value[0])
+	if err != nil || n < 0 || n >= sharedIntegersCount || strconv.Itoa(n) != value[0] {
+		return nil, false
+	}
+	return sharedIntegers[n], true
 }
 
 func (c *Redis) set(key string, value []string) {
-	c.db[key] = value
+	if shared, ok := sharedInteger(value); ok {
+		value = shared
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db[c.normalizeKey(key)] = value
 }
-func (c *Redis) get(key string) []string {
-	val := c.db[key]
-	return val
+
+// get returns the value at key. The second result is false when the key
+// does not exist.
+func (c *Redis) get(key string) ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	val, ok := c.db[c.normalizeKey(key)]
+	return val, ok
 }
 func (c *Redis) del(key string) {
-	delete(c.db, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.db, c.normalizeKey(key))
+}
+
+// delCount deletes keys and returns how many elements they held in
+// total. Redis counts a hash's fields, but values here are untyped and
+// a hash can't be told from a list of the same strings, so a hash is
+// overcounted: each field and each value counts as an element.
+func (c *Redis) delCount(keys []string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	freed := 0
+	for _, key := range keys {
+		key = c.normalizeKey(key)
+		freed += len(c.db[key])
+		delete(c.db, key)
+	}
+	return freed
+}
+
+// populate creates count keys named prefix:0 .. prefix:count-1 holding
+// value:0 .. value:count-1, the way Redis's DEBUG POPULATE does. Keys
+// that already exist are left untouched.
+func (c *Redis) populate(count int, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < count; i++ {
+		key := c.normalizeKey(prefix + ":" + strconv.Itoa(i))
+		if _, ok := c.db[key]; ok {
+			continue
+		}
+		c.db[key] = []string{"value:" + strconv.Itoa(i)}
+	}
+}
+
+// refcount reports how many references the value at key has: the
+// shared refcount for a shared integer and 1 otherwise. The second
+// result is false when the key does not exist.
+func (c *Redis) refcount(key string) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	val, ok := c.db[c.normalizeKey(key)]
+	if !ok {
+		return 0, false
+	}
+	if shared, isInt := sharedInteger(val); isInt && &shared[0] == &val[0] {
+		return sharedRefcount, true
+	}
+	return 1, true
+}
+
+// keyOverhead is a rough per-key cost on top of the key and its
+// encoded value: the map entry plus the string and slice headers.
+const keyOverhead = 64
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter struct {
+	n int
+}
+
+func (w *byteCounter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// encodedSize returns the gob-encoded size of value in bytes.
+func encodedSize(value []string) int {
+	var counter byteCounter
+	// Encoding a []string into a counter cannot fail.
+	gob.NewEncoder(&counter).Encode(value)
+	return counter.n
+}
+
+// defaultMemorySamples is how many elements MEMORY USAGE encodes when
+// no SAMPLES option is given, as in Redis.
+const defaultMemorySamples = 5
+
+// estimatedSize estimates the gob-encoded size of value from at most
+// samples evenly spaced elements, scaling their encoded size up to the
+// full length. samples <= 0 encodes every element.
+func estimatedSize(value []string, samples int) int {
+	if samples <= 0 || samples >= len(value) {
+		return encodedSize(value)
+	}
+	sample := make([]string, samples)
+	for i := range sample {
+		sample[i] = value[i*len(value)/samples]
+	}
+	// Only the elements scale with the length, not the encoding header.
+	header := encodedSize(nil)
+	perElements := encodedSize(sample) - header
+	return header + perElements*len(value)/samples
+}
+
+// memoryUsage estimates the bytes used by key and its value: the gob
+// encoding of the value (sampled as estimatedSize does) plus the key and
+// a fixed per-key overhead. The second result is false when the key
+// does not exist.
+func (c *Redis) memoryUsage(key string, samples int) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key = c.normalizeKey(key)
+	val, ok := c.db[key]
+	if !ok {
+		return 0, false
+	}
+	return estimatedSize(val, samples) + len(key) + keyOverhead, true
+}
+
+// memoryStatsSamples is the most keys MEMORY STATS looks at; the
+// dataset size is extrapolated from them.
+const memoryStatsSamples = 1000
+
+// memoryStats summarises keyspace memory for MEMORY STATS. Sizes are
+// estimated as memoryUsage does.
+type memoryStats struct {
+	keys         int
+	sampled      int
+	datasetBytes int
+	overhead     int
+	largestKey   string
+	largestBytes int
+}
+
+// memoryStats measures up to memoryStatsSamples keys under the read
+// lock. Map iteration order is random, so they are a random sample.
+func (c *Redis) memoryStats() memoryStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := memoryStats{keys: len(c.db), overhead: len(c.db) * keyOverhead}
+	sampledBytes := 0
+	for key, val := range c.db {
+		if stats.sampled == memoryStatsSamples {
+			break
+		}
+		stats.sampled++
+		size := estimatedSize(val, defaultMemorySamples) + len(key)
+		sampledBytes += size
+		if size > stats.largestBytes {
+			stats.largestKey, stats.largestBytes = key, size
+		}
+	}
+	if stats.sampled > 0 {
+		stats.datasetBytes = sampledBytes * stats.keys / stats.sampled
+	}
+	return stats
+}
+
+// bitmap returns the string at key as bytes for the bit commands. Values
+// holding several elements are read the way GET shows them, joined by
+// spaces. c.mu must be held and key normalized.
+func (c *Redis) bitmap(key string) []byte {
+	return []byte(strings.Join(c.db[key], " "))
+}
+
+// setBit sets the bit at offset in the string at key to bit, growing the
+// string with zero bytes as needed, and returns the previous bit. Bit 0
+// is the most significant bit of the first byte, as in Redis.
+func (c *Redis) setBit(key string, offset int, bit byte) byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = c.normalizeKey(key)
+	bits := c.bitmap(key)
+	if need := offset/8 + 1; need > len(bits) {
+		bits = append(bits, make([]byte, need-len(bits))...)
+	}
+	mask := byte(0x80) >> (offset % 8)
+	old := byte(0)
+	if bits[offset/8]&mask != 0 {
+		old = 1
+	}
+	if bit == 1 {
+		bits[offset/8] |= mask
+	} else {
+		bits[offset/8] &^= mask
+	}
+	c.db[key] = []string{string(bits)}
+	return old
+}
+
+// getBit returns the bit at offset in the string at key, 0 past its end.
+func (c *Redis) getBit(key string, offset int) byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	bits := c.bitmap(c.normalizeKey(key))
+	if offset/8 >= len(bits) {
+		return 0
+	}
+	return bits[offset/8] >> (7 - offset%8) & 1
+}
+
+// byteRange clamps the inclusive byte range start..end to a string of n
+// bytes, counting negative indexes from the end. It reports false when
+// nothing is left of the range.
+func byteRange(start, end, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	return start, end, start <= end
+}
+
+// bitCount counts the set bits in bytes start..end of the string at key.
+// It gives up with errCommandTimeout once deadline passes.
+func (c *Redis) bitCount(key string, start, end int, deadline time.Time) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	bitmap := c.bitmap(c.normalizeKey(key))
+	start, end, ok := byteRange(start, end, len(bitmap))
+	if !ok {
+		return 0, nil
+	}
+	count := 0
+	for i, b := range bitmap[start : end+1] {
+		if (i+1)%deadlineCheckInterval == 0 && c.expired(deadline) {
+			return 0, errCommandTimeout
+		}
+		count += bits.OnesCount8(b)
+	}
+	return count, nil
+}
+
+// bitPos returns the position of the first bit equal to bit within bytes
+// start..end of the string at key, or -1 if there is none. As in Redis,
+// when looking for a 0 without an explicit end, the string is treated
+// as padded with zeros, so a run of 1s yields the first bit past it. It
+// gives up with errCommandTimeout once deadline passes.
+func (c *Redis) bitPos(key string, bit byte, start, end int, explicitEnd bool, deadline time.Time) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	bitmap := c.bitmap(c.normalizeKey(key))
+	if len(bitmap) == 0 {
+		if bit == 0 {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	start, end, ok := byteRange(start, end, len(bitmap))
+	if !ok {
+		return -1, nil
+	}
+	for i, n := start, 1; i <= end; i, n = i+1, n+1 {
+		if n%deadlineCheckInterval == 0 && c.expired(deadline) {
+			return 0, errCommandTimeout
+		}
+		for j := 0; j < 8; j++ {
+			if bitmap[i]>>(7-j)&1 == bit {
+				return i*8 + j, nil
+			}
+		}
+	}
+	if bit == 0 && !explicitEnd {
+		return (end + 1) * 8, nil
+	}
+	return -1, nil
+}
+
+// exportJSON encodes the whole keyspace as a JSON object mapping each
+// key to its value, holding the read lock while encoding. Keys are
+// encoded one at a time in sorted order, giving the same bytes as
+// json.Marshal of the map, so that the encoding can give up with
+// errCommandTimeout once deadline passes.
+func (c *Redis) exportJSON(deadline time.Time) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.db))
+	for key := range c.db {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range keys {
+		if (i+1)%deadlineCheckInterval == 0 && c.expired(deadline) {
+			return nil, errCommandTimeout
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(c.db[key])
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// dumpPath resolves the file name a client gave DUMPALL or IMPORT inside
+// dir. Absolute names and names climbing out with ".." are rejected, so
+// clients can't reach arbitrary files the server can write or read.
+func dumpPath(dir, name string) (string, error) {
+	if dir == "" {
+		return "", errNoDumpDir
+	}
+	if !filepath.IsLocal(name) {
+		return "", errDumpPath
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// importJSON loads a dump written by exportJSON. Imported keys overwrite
+// keys of the same name and every other key is kept; with replace the
+// keyspace is emptied first, so it ends up holding exactly the dump. It
+// returns the number of keys imported. The dump is checked against the
+// -maxkeylen and -maxvalue limits (zero for none) as if each key were
+// written by a client, and nothing is imported unless every key passes.
+func (c *Redis) importJSON(dump []byte, replace bool, maxKeyLen, maxValue int) (int, error) {
+	var imported map[string][]string
+	if err := json.Unmarshal(dump, &imported); err != nil {
+		return 0, err
+	}
+	for key, val := range imported {
+		if len(val) == 0 {
+			return 0, &commandError{"ERR", fmt.Sprintf("dump has no value for key '%s'", key)}
+		}
+		if maxKeyLen > 0 && len(key) > maxKeyLen {
+			return 0, errKeyTooLong
+		}
+		for _, v := range val {
+			if maxValue > 0 && len(v) > maxValue {
+				return 0, errValueTooLarge
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if replace {
+		c.db = make(map[string][]string)
+	}
+	for key, val := range imported {
+		key = c.normalizeKey(key)
+		c.db[key] = val
+		c.wakeLocked(key)
+	}
+	return len(imported), nil
+}
+
+// Hashes are stored the way HMSET writes them: a flat list of
+// alternating fields and values.
+
+// hashIndex returns the index of field's value in the hash h, or -1 if
+// the field is not set.
+func hashIndex(h []string, field string) int {
+	for i := 0; i+1 < len(h); i += 2 {
+		if h[i] == field {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// defaultScanCount is how many entries a SCAN-family call looks at when
+// no COUNT is given.
+const defaultScanCount = 10
+
+// hscan returns up to count field/value pairs of the hash at key, starting
+// at the cursor-th field, and the cursor to continue from, which is 0 once
+// the hash is exhausted. Fields not matching pattern are left out of the
+// reply, so a call may return fewer pairs than count, or none. As with
+// SCAN in Redis, the guarantee is weak: the cursor is a position in the
+// hash, so if it is rewritten between calls a field may be skipped or
+// returned twice.
+func (c *Redis) hscan(key string, cursor, count int, pattern string) (int, []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := c.db[c.normalizeKey(key)]
+	var pairs []string
+	i := cursor
+	for ; i < len(h)/2 && i < cursor+count; i++ {
+		field, value := h[2*i], h[2*i+1]
+		if pattern != "" && !stringMatch(pattern, field) {
+			continue
+		}
+		pairs = append(pairs, field, value)
+	}
+	if i >= len(h)/2 {
+		i = 0
+	}
+	return i, pairs
+}
+
+// hsetnx sets field in the hash at key only if it is not set yet,
+// creating the hash if needed. It returns 1 if the field was set and 0
+// otherwise.
+func (c *Redis) hsetnx(key, field, value string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = c.normalizeKey(key)
+	h := c.db[key]
+	if hashIndex(h, field) >= 0 {
+		return 0
+	}
+	updated := make([]string, 0, len(h)+2)
+	updated = append(updated, h...)
+	c.db[key] = append(updated, field, value)
+	return 1
+}
+
+// nilReply stands in for a missing value in plaintext replies.
+const nilReply = "(nil)"
+
+// hexists reports whether field is set in the hash at key.
+func (c *Redis) hexists(key string, field string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return hashIndex(c.db[c.normalizeKey(key)], field) >= 0
+}
+
+// hlen returns the number of fields in the hash at key.
+func (c *Redis) hlen(key string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.db[c.normalizeKey(key)]) / 2
+}
+
+// hmget returns the values of fields in the hash at key, in order and
+// quoted with quoteArg, with nilReply for every field that is not set.
+func (c *Redis) hmget(key string, fields []string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := c.db[c.normalizeKey(key)]
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		if j := hashIndex(h, field); j >= 0 {
+			values[i] = quoteArg(h[j])
+		} else {
+			values[i] = nilReply
+		}
+	}
+	return values
+}
+
+// flush removes every key. A synchronous flush empties the map while
+// holding the lock; an async one swaps in a fresh map and leaves the old
+// one to be emptied by a background goroutine, so the lock is only held
+// for the swap.
+func (c *Redis) flush(async bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !async {
+		for key := range c.db {
+			delete(c.db, key)
+		}
+		return
+	}
+	old := c.db
+	c.db = make(map[string][]string)
+	go func() {
+		for key := range old {
+			delete(old, key)
+		}
+	}()
+}
+
+// push adds values to the head (left) or tail of the list at key and
+// returns its new length. With onlyIfExists a missing key is left alone
+// and 0 is returned.
+func (c *Redis) push(key string, values []string, left, onlyIfExists bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = c.normalizeKey(key)
+	if _, ok := c.db[key]; !ok && onlyIfExists {
+		return 0
+	}
+	return c.pushLocked(key, values, left)
+}
+
+// pop removes up to count elements from the head (left) or tail of the
+// list at key and returns them in the order they were popped. A list
+// left empty is deleted.
+func (c *Redis) pop(key string, count int, left bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.popLocked(c.normalizeKey(key), count, left)
+}
+
+// move pops one element from src and pushes it onto dst in a single
+// locked step, so the element is never missing from both lists. The
+// second result is false when src is empty.
+func (c *Redis) move(src, dst string, fromLeft, toLeft bool) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	popped := c.popLocked(c.normalizeKey(src), 1, fromLeft)
+	if len(popped) == 0 {
+		return "", false
+	}
+	c.pushLocked(c.normalizeKey(dst), popped, toLeft)
+	return popped[0], true
+}
+
+// blockingPop pops one element from the first non-empty list among
+// keys, returning that key and the element. When every list is empty it
+// waits for a push for up to timeout (forever when zero) and returns two
+// empty strings if none arrives, or as soon as gone is closed because
+// the client went away. The lock is released while waiting.
+func (c *Redis) blockingPop(keys []string, left bool, timeout time.Duration, gone <-chan struct{}) (string, string) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		key, popped, wake := c.popOrWait(keys, left)
+		if wake == nil {
+			return key, popped
+		}
+
+		timedOut := false
+		select {
+		case <-wake:
+		case <-expired:
+			timedOut = true
+		case <-gone:
+			timedOut = true
+		}
+
+		c.stopWaiting(keys, wake)
+		if timedOut {
+			return "", ""
+		}
+	}
+}
+
+// popOrWait pops one element from the first non-empty list among keys
+// and returns that key and the element. If every list is empty it
+// instead registers and returns a channel that a push to any of the keys
+// will signal. Both happen under one lock so no push is missed between
+// them.
+func (c *Redis) popOrWait(keys []string, left bool) (string, string, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if popped := c.popLocked(c.normalizeKey(key), 1, left); len(popped) > 0 {
+			return key, popped[0], nil
+		}
+	}
+	wake := make(chan struct{}, 1)
+	for _, key := range keys {
+		key = c.normalizeKey(key)
+		c.waiters[key] = append(c.waiters[key], wake)
+	}
+	return "", "", wake
+}
+
+// stopWaiting unregisters wake from keys once its pop stops waiting.
+func (c *Redis) stopWaiting(keys []string, wake chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		key = c.normalizeKey(key)
+		waiting := c.waiters[key][:0]
+		for _, ch := range c.waiters[key] {
+			if ch != wake {
+				waiting = append(waiting, ch)
+			}
+		}
+		if len(waiting) == 0 {
+			delete(c.waiters, key)
+		} else {
+			c.waiters[key] = waiting
+		}
+	}
+}
+
+// stringMatch reports whether s matches the glob pattern, the way Redis
+// matches KEYS and SCAN patterns: '*' matches any run of bytes, '?' any
+// single byte, "[...]" a byte in the class (with '^' negating it and
+// "a-z" ranges), and '\\' makes the next byte literal.
+func stringMatch(pattern, s string) bool {
+	// p and i walk pattern and s. On a mismatch the most recent '*' is
+	// made to swallow one more byte and matching resumes after it. Only
+	// the last '*' matters, since earlier ones can only have matched
+	// less, so this takes O(len(pattern) * len(s)) steps rather than
+	// backtracking through every star: a hostile MATCH pattern can't
+	// stall a scan that holds the read lock.
+	p, i := 0, 0
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starI = p, i
+				p++
+				continue
+			case '?':
+				p, i = p+1, i+1
+				continue
+			case '[':
+				matched, rest := matchClass(pattern[p+1:], s[i])
+				if matched {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+			case '\\':
+				literal, width := byte('\\'), 1
+				if p+1 < len(pattern) {
+					literal, width = pattern[p+1], 2
+				}
+				if s[i] == literal {
+					p, i = p+width, i+1
+					continue
+				}
+			default:
+				if s[i] == pattern[p] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches b against the character class at the start of
+// pattern, just after its '['. It returns whether b is in the class and
+// the rest of the pattern after the closing ']'. An unterminated class
+// runs to the end of the pattern.
+func matchClass(pattern string, b byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			matched = matched || pattern[1] == b
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= b && b <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == b
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
+
+// deadlineCheckInterval is how many elements a scan visits between
+// looks at the clock.
+const deadlineCheckInterval = 1024
+
+// expired reports whether deadline has passed. A zero deadline never
+// expires.
+func (c *Redis) expired(deadline time.Time) bool {
+	return !deadline.IsZero() && c.now().After(deadline)
+}
+
+// positions returns the indexes of element in the list at key. Matching
+// starts at the rank-th match, counting from the tail when rank is
+// negative, and stops after count matches (count 0 returns them all).
+// It gives up with errCommandTimeout once deadline passes, so a long
+// list doesn't hold the lock indefinitely.
+func (c *Redis) positions(key, element string, rank, count int, deadline time.Time) ([]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := c.db[c.normalizeKey(key)]
+
+	start, end, step := 0, len(list), 1
+	skip := rank - 1
+	if rank < 0 {
+		start, end, step = len(list)-1, -1, -1
+		skip = -rank - 1
+	}
+	var found []int
+	for i, n := start, 1; i != end; i, n = i+step, n+1 {
+		if n%deadlineCheckInterval == 0 && c.expired(deadline) {
+			return nil, errCommandTimeout
+		}
+		if list[i] != element {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		found = append(found, i)
+		if count > 0 && len(found) == count {
+			break
+		}
+	}
+	return found, nil
+}
+
+// sortList returns the elements of the list at key in order, compared
+// as numbers unless alpha is set, then skips offset of them and keeps
+// count (a negative count keeps the rest). The list itself is left as
+// it is.
+func (c *Redis) sortList(key string, alpha, desc bool, offset, count int) ([]string, error) {
+	// Stored lists are never modified in place, so copying the one get
+	// returns is safe without the lock.
+	list, _ := c.get(key)
+	list = append([]string(nil), list...)
+
+	if alpha {
+		sort.Strings(list)
+	} else {
+		scores := make(map[string]float64, len(list))
+		for _, element := range list {
+			score, err := strconv.ParseFloat(element, 64)
+			if err != nil {
+				return nil, errSortNotNumber
+			}
+			scores[element] = score
+		}
+		sort.SliceStable(list, func(i, j int) bool { return scores[list[i]] < scores[list[j]] })
+	}
+	if desc {
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if count >= 0 && count < len(list) {
+		list = list[:count]
+	}
+	return list, nil
+}
+
+// insert puts value before or after the first occurrence of pivot in
+// the list at key and returns the new length. It returns 0 when the key
+// does not exist and -1 when pivot is not in the list.
+func (c *Redis) insert(key, pivot, value string, before bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = c.normalizeKey(key)
+	list, ok := c.db[key]
+	if !ok {
+		return 0
+	}
+	for i, element := range list {
+		if element != pivot {
+			continue
+		}
+		if !before {
+			i++
+		}
+		inserted := make([]string, 0, len(list)+1)
+		inserted = append(inserted, list[:i]...)
+		inserted = append(inserted, value)
+		inserted = append(inserted, list[i:]...)
+		c.db[key] = inserted
+		return len(inserted)
+	}
+	return -1
+}
+
+// trim keeps only the elements of the list at key between start and
+// stop inclusive. Negative indexes count from the tail. A list trimmed
+// to nothing is deleted.
+func (c *Redis) trim(key string, start, stop int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = c.normalizeKey(key)
+	list := c.db[key]
+	if start < 0 {
+		start += len(list)
+	}
+	if stop < 0 {
+		stop += len(list)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
+	if start > stop {
+		delete(c.db, key)
+		return
+	}
+	c.db[key] = append([]string(nil), list[start:stop+1]...)
+}
+
+// pushLocked and popLocked expect c.mu to be held and key to be
+// normalized already.
+
+func (c *Redis) pushLocked(key string, values []string, left bool) int {
+	list := c.db[key]
+	if left {
+		// Each value is pushed in turn, so the last one ends up first.
+		pushed := make([]string, 0, len(values)+len(list))
+		for i := len(values) - 1; i >= 0; i-- {
+			pushed = append(pushed, values[i])
+		}
+		list = append(pushed, list...)
+	} else {
+		list = append(list, values...)
+	}
+	c.db[key] = list
+	c.wakeLocked(key)
+	return len(list)
+}
+
+// wakeLocked wakes every blocked pop waiting on key; they race to pop
+// again once the lock is released. c.mu must be held.
+func (c *Redis) wakeLocked(key string) {
+	for _, wake := range c.waiters[key] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	delete(c.waiters, key)
+}
+
+func (c *Redis) popLocked(key string, count int, left bool) []string {
+	list := c.db[key]
+	if count > len(list) {
+		count = len(list)
+	}
+	popped := make([]string, 0, count)
+	if left {
+		popped = append(popped, list[:count]...)
+		list = list[count:]
+	} else {
+		for i := len(list) - 1; i >= len(list)-count; i-- {
+			popped = append(popped, list[i])
+		}
+		// Clip the capacity too: a reader may still hold the longer
+		// slice from get, and the next push must not write into it.
+		n := len(list) - count
+		list = list[:n:n]
+	}
+	if len(list) == 0 {
+		delete(c.db, key)
+	} else {
+		c.db[key] = list
+	}
+	return popped
+}
+
+// aclUser is a single entry of the ACL file: a password and the set of
+// commands the user may run.
+type aclUser struct {
+	password    string
+	commands    map[string]bool
+	allCommands bool
+}
+
+func (u *aclUser) allowed(command string) bool {
+	return u.allCommands || u.commands[command]
+}
+
+// accessList maps usernames to their ACL entry. A nil accessList means
+// no ACL was configured and every connection may run every command.
+type accessList map[string]*aclUser
+
+func (acl accessList) authenticate(username, password string) (*aclUser, bool) {
+	u, ok := acl[username]
+	if !ok {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) != 1 {
+		return nil, false
+	}
+	return u, true
+}
+
+// loadACL reads an ACL file where every non-empty line that does not
+// start with '#' has the form
+//
+//	<user> <password> <command>[,<command>...]
+//
+// and the command list "*" grants every command.
+func loadACL(path string) (accessList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := accessList{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"user password commands\"", path, lineNo)
+		}
+		u := &aclUser{password: fields[1], commands: map[string]bool{}}
+		for _, command := range strings.Split(fields[2], ",") {
+			if command == "*" {
+				u.allCommands = true
+				continue
+			}
+			u.commands[strings.ToUpper(command)] = true
+		}
+		acl[fields[0]] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// commandError is an error reply. kind is the leading word clients use
+// to tell errors apart (ERR, NOAUTH, NOPERM, ...), as in Redis.
+type commandError struct {
+	kind    string
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.kind + " " + e.message
+}
+
+var (
+	errEmptyCommand     = &commandError{"ERR", "empty command"}
+	errSyntax           = &commandError{"ERR", "syntax error"}
+	errNotInteger       = &commandError{"ERR", "value is not an integer or out of range"}
+	errNotFloat         = &commandError{"ERR", "value is not a valid float"}
+	errTimeout          = &commandError{"ERR", "timeout is not a float or out of range"}
+	errBit              = &commandError{"ERR", "bit is not an integer or out of range"}
+	errBitOffset        = &commandError{"ERR", "bit offset is not an integer or out of range"}
+	errRankZero         = &commandError{"ERR", "RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"}
+	errSortNotNumber    = &commandError{"ERR", "One or more scores can't be converted into double"}
+	errInvalidCursor    = &commandError{"ERR", "invalid cursor"}
+	errRateLimited      = &commandError{"ERR", "max number of commands per second exceeded"}
+	errNoDumpDir        = &commandError{"ERR", "dump files are disabled, start the server with -dump-dir"}
+	errDumpPath         = &commandError{"ERR", "dump file name must be a relative path inside -dump-dir"}
+	errUnbalancedQuotes = &commandError{"ERR", "Protocol error: unbalanced quotes in request"}
+	errCountNegative    = &commandError{"ERR", "COUNT can't be negative"}
+	errNoAuth           = &commandError{"NOAUTH", "Authentication required"}
+	errWrongPass        = &commandError{"WRONGPASS", "invalid username-password pair"}
+	errNoACL            = &commandError{"ERR", "AUTH called without any ACL configured"}
+	errValueTooLarge    = &commandError{"ERR", "value exceeds the -maxvalue limit"}
+	errKeyTooLong       = &commandError{"ERR", "key exceeds the -maxkeylen limit"}
+	errCommandTimeout   = &commandError{"ERR", "command exceeded the -command-timeout limit"}
+)
+
+func errArity(command string) error {
+	return &commandError{"ERR", fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(command))}
+}
+
+func errUnknownCommand(command string) error {
+	return &commandError{"ERR", fmt.Sprintf("unknown command '%s'", command)}
+}
+
+func errUnknownSubcommand(command, subcommand string) error {
+	return &commandError{"ERR", fmt.Sprintf("unknown subcommand '%s' for '%s'", subcommand, strings.ToLower(command))}
+}
+
+func errNoPerm(command string) error {
+	return &commandError{"NOPERM", fmt.Sprintf("this user has no permissions to run the '%s' command", strings.ToLower(command))}
+}
+
+// writeError sends err to the client as an error reply: a '-' followed
+// by the error kind and message. Like Redis, line breaks in the message,
+// which may quote a client's argument, are sent as spaces so the reply
+// stays on one line.
+func writeError(w io.Writer, err error) {
+	if _, ok := err.(*commandError); !ok {
+		err = &commandError{"ERR", err.Error()}
+	}
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	w.Write([]byte("-" + msg + "\n"))
 }
 
 type RedisCommand struct {
-	command string
-	key     string
-	value   []string
+	command    string
+	subcommand string
+	key        string
+	value      []string
+	// from and to are the LEFT/RIGHT ends LMOVE pops from and pushes to.
+	from   string
+	to     string
+	count  int
+	offset int
+	bit    byte
+	rank   int
+	start  int
+	stop   int
+	// explicitEnd records that BITPOS was given an end byte.
+	explicitEnd bool
+	duration    time.Duration
+	// alpha and desc are the SORT ordering modifiers.
+	alpha bool
+	desc  bool
 }
 
-func (cmd *RedisCommand) parse(query string) (err error) {
+// valueTooLarge reports whether cmd stores a value longer than max bytes.
+func (cmd *RedisCommand) valueTooLarge(max int) bool {
+	switch cmd.command {
+	case "SET", "HMSET", "HSETNX", "LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LINSERT":
+		for _, v := range cmd.value {
+			if len(v) > max {
+				return true
+			}
+		}
+	case "SETBIT":
+		return cmd.offset/8+1 > max
+	}
+	return false
+}
+
+// keyTooLong reports whether cmd writes to a key longer than max bytes.
+// Reads of long keys are left alone; they simply find nothing.
+func (cmd *RedisCommand) keyTooLong(max int) bool {
+	switch cmd.command {
+	case "SET", "HMSET", "HSETNX", "LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LINSERT", "SETBIT":
+		return len(cmd.key) > max
+	case "RPOPLPUSH", "LMOVE":
+		return len(cmd.value[0]) > max
+	}
+	return false
+}
+
+// splitArgs splits a request line into arguments the way redis-cli does.
+// Arguments are separated by spaces or tabs. An argument starting with a
+// double quote runs to the matching quote and may contain separators and
+// the escapes \n, \r, \t, \b, \a, \xHH and a backslash before any other
+// byte; one starting with a single quote is taken literally apart from
+// \'. A closing quote must be followed by a separator or the end of the
+// line.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg strings.Builder
+		switch quote := line[i]; quote {
+		case '"', '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				if line[i] == quote {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					arg.WriteByte(unescape(line, &i, quote))
+					continue
+				}
+				arg.WriteByte(line[i])
+				i++
+			}
+			if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				return nil, errUnbalancedQuotes
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg.WriteByte(line[i])
+				i++
+			}
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// unescape decodes the escape whose backslash is just before line[*i]
+// inside a quoted argument and advances *i past it. Within single quotes
+// only \' is an escape; any other backslash is kept as is.
+func unescape(line string, i *int, quote byte) byte {
+	ch := line[*i]
+	if quote == '\'' {
+		if ch != '\'' {
+			return '\\'
+		}
+		*i++
+		return ch
+	}
+	*i++
+	switch ch {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	case 'x':
+		if *i+2 <= len(line) {
+			if n, err := strconv.ParseUint(line[*i:*i+2], 16, 8); err == nil {
+				*i += 2
+				return byte(n)
+			}
+		}
+	}
+	return ch
+}
 
-	query = strings.Replace(query, "\r\n", " ", -1)
-	query = strings.Replace(query, "\n", " ", -1)
-	queryArray := strings.Split(query, " ")
+// quoteArg renders s for a reply so that splitArgs reads it back as the
+// same single argument. Plain values are sent as they are. An empty
+// value, one that would not survive splitting (separators, control
+// bytes, a leading quote) and a value that reads as nilReply are sent
+// double-quoted with escapes instead.
+func quoteArg(s string) string {
+	plain := s != "" && s != nilReply && s[0] != '"' && s[0] != '\''
+	for i := 0; plain && i < len(s); i++ {
+		plain = s[i] > ' ' && s[i] != 0x7f
+	}
+	if plain {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\a':
+			b.WriteString(`\a`)
+		default:
+			if ch < ' ' || ch == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
 
-	var command []string
-	for _, v := range queryArray {
-		if v != "" {
-			command = append(command, v)
+// quoteArgs renders args as a single reply line of arguments quoted
+// with quoteArg.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (cmd *RedisCommand) parse(query string) (err error) {
+	// readLine leaves the line terminator on; anything inside the line,
+	// including newlines written as \n in quotes, belongs to the command.
+	query = strings.TrimSuffix(query, "\n")
+	query = strings.TrimSuffix(query, "\r")
+	command, err := splitArgs(query)
+	if err != nil {
+		return err
+	}
+	if len(command) == 0 {
+		err = errEmptyCommand
+		return
+	}
+	cmd.command = command[0]
+	switch cmd.command {
+	case "PING":
+		{
+			return nil
+		}
+	case "TIME", "ROLE", "LOLWUT", "VERSION":
+		{
+			return nil
+		}
+	case "AUTH":
+		{
+			// AUTH <password> authenticates as the "default" user,
+			// AUTH <user> <password> as the named one.
+			switch len(command) {
+			case 2:
+				cmd.key = "default"
+				cmd.value = append(cmd.value, command[1])
+			case 3:
+				cmd.key = command[1]
+				cmd.value = append(cmd.value, command[2])
+			default:
+				err = errArity(cmd.command)
+				return
+			}
+		}
+	case "ECHO":
+		{
+			if len(command) != 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.value = append(cmd.value, command[1])
+		}
+	case "GET":
+		{
+			if len(command) < 2 {
+				return errArity(cmd.command)
+			}
+			cmd.key = command[1]
+		}
+	case "SET":
+		{
+			if len(command) < 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2])
+		}
+	case "DEL":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+		}
+	case "HMSET":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2:]...)
+		}
+	case "HSETNX":
+		{
+			if len(command) != 4 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2], command[3])
+		}
+	case "HEXISTS":
+		{
+			if len(command) != 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2])
+		}
+	case "HLEN":
+		{
+			if len(command) != 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+		}
+	case "HSCAN":
+		{
+			if len(command) < 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cursor, perr := strconv.Atoi(command[2])
+			if perr != nil || cursor < 0 {
+				err = errInvalidCursor
+				return
+			}
+			cmd.offset = cursor
+			cmd.count = defaultScanCount
+			for i := 3; i < len(command); i += 2 {
+				if i+1 >= len(command) {
+					err = errSyntax
+					return
+				}
+				switch command[i] {
+				case "MATCH":
+					cmd.value = []string{command[i+1]}
+				case "COUNT":
+					n, perr := strconv.Atoi(command[i+1])
+					if perr != nil {
+						err = errNotInteger
+						return
+					}
+					if n < 1 {
+						err = errSyntax
+						return
+					}
+					cmd.count = n
+				default:
+					err = errSyntax
+					return
+				}
+			}
+		}
+	case "HMGET":
+		{
+			if len(command) < 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2:]...)
+		}
+	case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
+		{
+			if len(command) < 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2:]...)
+		}
+	case "LPOP", "RPOP":
+		{
+			if len(command) < 2 || len(command) > 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.count = 1
+			if len(command) == 3 {
+				cmd.count, err = strconv.Atoi(command[2])
+				if err != nil || cmd.count < 0 {
+					err = errNotInteger
+					return
+				}
+			}
 		}
-	}
-	cmd.command = command[0]
-	switch cmd.command {
-	case "PING":
+	case "RPOPLPUSH":
 		{
-			return nil
+			if len(command) != 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2])
+			cmd.from = "RIGHT"
+			cmd.to = "LEFT"
 		}
-	case "GET":
+	case "LMOVE":
+		{
+			if len(command) != 5 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[2])
+			cmd.from = command[3]
+			cmd.to = command[4]
+			for _, where := range []string{cmd.from, cmd.to} {
+				if where != "LEFT" && where != "RIGHT" {
+					err = errSyntax
+					return
+				}
+			}
+		}
+	case "BLPOP", "BRPOP":
+		{
+			if len(command) < 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			seconds, perr := strconv.ParseFloat(command[len(command)-1], 64)
+			if perr != nil || seconds < 0 {
+				err = errTimeout
+				return
+			}
+			cmd.key = command[1]
+			cmd.value = append(cmd.value, command[1:len(command)-1]...)
+			cmd.duration = time.Duration(seconds * float64(time.Second))
+		}
+	case "CLIENT":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.subcommand = command[1]
+			switch cmd.subcommand {
+			case "ID":
+				if len(command) != 2 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+			default:
+				err = errUnknownSubcommand(cmd.command, cmd.subcommand)
+				return
+			}
+		}
+	case "FLUSHDB", "FLUSHALL":
+		{
+			switch len(command) {
+			case 1:
+			case 2:
+				if command[1] != "ASYNC" && command[1] != "SYNC" {
+					err = errSyntax
+					return
+				}
+				cmd.subcommand = command[1]
+			default:
+				err = errSyntax
+				return
+			}
+		}
+	case "SORT":
 		{
 			if len(command) < 2 {
-				err := fmt.Errorf("invalid command")
-				return err
+				err = errArity(cmd.command)
+				return
 			}
 			cmd.key = command[1]
+			cmd.count = -1
+			for i := 2; i < len(command); i++ {
+				switch command[i] {
+				case "ALPHA":
+					cmd.alpha = true
+				case "ASC":
+					cmd.desc = false
+				case "DESC":
+					cmd.desc = true
+				case "LIMIT":
+					if i+2 >= len(command) {
+						err = errSyntax
+						return
+					}
+					offset, oerr := strconv.Atoi(command[i+1])
+					count, cerr := strconv.Atoi(command[i+2])
+					if oerr != nil || cerr != nil {
+						err = errNotInteger
+						return
+					}
+					cmd.offset, cmd.count = offset, count
+					i += 2
+				default:
+					err = errSyntax
+					return
+				}
+			}
 		}
-	case "SET":
+	case "LPOS":
 		{
 			if len(command) < 3 {
-				err = fmt.Errorf("invalid command")
+				err = errArity(cmd.command)
 				return
 			}
 			cmd.key = command[1]
 			cmd.value = append(cmd.value, command[2])
+			cmd.rank = 1
+			cmd.count = 1
+			for i := 3; i < len(command); i += 2 {
+				if i+1 >= len(command) {
+					err = errSyntax
+					return
+				}
+				n, perr := strconv.Atoi(command[i+1])
+				if perr != nil {
+					err = errNotInteger
+					return
+				}
+				switch command[i] {
+				case "RANK":
+					if n == 0 {
+						err = errRankZero
+						return
+					}
+					cmd.rank = n
+				case "COUNT":
+					if n < 0 {
+						err = errCountNegative
+						return
+					}
+					cmd.count = n
+				default:
+					err = errSyntax
+					return
+				}
+			}
 		}
-	case "DEL":
+	case "LINSERT":
 		{
-			if len(command) < 2 {
-				err = fmt.Errorf("invalid command")
+			if len(command) != 5 {
+				err = errArity(cmd.command)
+				return
+			}
+			if command[2] != "BEFORE" && command[2] != "AFTER" {
+				err = errSyntax
 				return
 			}
 			cmd.key = command[1]
+			cmd.subcommand = command[2]
+			cmd.value = append(cmd.value, command[3], command[4])
 		}
-	case "HMSET":
+	case "LTRIM":
+		{
+			if len(command) != 4 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.key = command[1]
+			start, serr := strconv.Atoi(command[2])
+			stop, perr := strconv.Atoi(command[3])
+			if serr != nil || perr != nil {
+				err = errNotInteger
+				return
+			}
+			cmd.start, cmd.stop = start, stop
+		}
+	case "OBJECT":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.subcommand = command[1]
+			switch cmd.subcommand {
+			case "REFCOUNT":
+				if len(command) != 3 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				cmd.key = command[2]
+			case "HELP":
+				if len(command) != 2 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+			default:
+				err = errUnknownSubcommand(cmd.command, cmd.subcommand)
+				return
+			}
+		}
+	case "INFO":
+		{
+			if len(command) > 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			if len(command) == 2 {
+				cmd.subcommand = command[1]
+			}
+		}
+	case "MEMORY":
 		{
 			if len(command) < 2 {
-				err = fmt.Errorf("invalid command")
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.subcommand = command[1]
+			switch cmd.subcommand {
+			case "USAGE":
+				if len(command) != 3 && (len(command) != 5 || command[3] != "SAMPLES") {
+					err = errSyntax
+					return
+				}
+				cmd.key = command[2]
+				cmd.count = defaultMemorySamples
+				if len(command) == 5 {
+					cmd.count, err = strconv.Atoi(command[4])
+					if err != nil || cmd.count < 0 {
+						err = errNotInteger
+						return
+					}
+				}
+			case "STATS":
+				if len(command) != 2 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+			default:
+				err = errUnknownSubcommand(cmd.command, cmd.subcommand)
+				return
+			}
+		}
+	case "SETBIT", "GETBIT":
+		{
+			if (cmd.command == "SETBIT" && len(command) != 4) || (cmd.command == "GETBIT" && len(command) != 3) {
+				err = errArity(cmd.command)
 				return
 			}
 			cmd.key = command[1]
-			cmd.value = append(cmd.value, command[2:]...)
+			// Offsets are capped at 2^32 bits (512MB), as in Redis.
+			offset, perr := strconv.ParseUint(command[2], 10, 32)
+			if perr != nil {
+				err = errBitOffset
+				return
+			}
+			cmd.offset = int(offset)
+			if cmd.command == "SETBIT" {
+				if command[3] != "0" && command[3] != "1" {
+					err = errBit
+					return
+				}
+				cmd.bit = command[3][0] - '0'
+			}
+		}
+	case "BITCOUNT":
+		{
+			if len(command) != 2 && len(command) != 4 {
+				err = errSyntax
+				return
+			}
+			cmd.key = command[1]
+			cmd.start, cmd.stop = 0, -1
+			if len(command) == 4 {
+				start, serr := strconv.Atoi(command[2])
+				stop, perr := strconv.Atoi(command[3])
+				if serr != nil || perr != nil {
+					err = errNotInteger
+					return
+				}
+				cmd.start, cmd.stop = start, stop
+			}
+		}
+	case "BITPOS":
+		{
+			if len(command) < 3 || len(command) > 5 {
+				err = errArity(cmd.command)
+				return
+			}
+			if command[2] != "0" && command[2] != "1" {
+				err = errBit
+				return
+			}
+			cmd.key = command[1]
+			cmd.bit = command[2][0] - '0'
+			cmd.start, cmd.stop = 0, -1
+			if len(command) >= 4 {
+				cmd.start, err = strconv.Atoi(command[3])
+				if err != nil {
+					err = errNotInteger
+					return
+				}
+			}
+			if len(command) == 5 {
+				cmd.stop, err = strconv.Atoi(command[4])
+				if err != nil {
+					err = errNotInteger
+					return
+				}
+				cmd.explicitEnd = true
+			}
+		}
+	case "DUMPALL":
+		{
+			// DUMPALL replies with the JSON dump, DUMPALL <path> writes it
+			// to path instead.
+			if len(command) > 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			if len(command) == 2 {
+				cmd.value = append(cmd.value, command[1])
+			}
+		}
+	case "IMPORT":
+		{
+			if len(command) < 2 || len(command) > 3 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.value = append(cmd.value, command[1])
+			if len(command) == 3 {
+				if command[2] != "REPLACE" {
+					err = errSyntax
+					return
+				}
+				cmd.subcommand = command[2]
+			}
+		}
+	case "CONFIG":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.subcommand = command[1]
+			switch cmd.subcommand {
+			case "GET":
+				if len(command) != 3 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				cmd.key = command[2]
+			case "SET":
+				if len(command) != 4 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				cmd.key = command[2]
+				cmd.value = append(cmd.value, command[3])
+			case "REWRITE":
+				if len(command) != 2 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+			default:
+				err = errUnknownSubcommand(cmd.command, cmd.subcommand)
+				return
+			}
+		}
+	case "DEBUG":
+		{
+			if len(command) < 2 {
+				err = errArity(cmd.command)
+				return
+			}
+			cmd.subcommand = command[1]
+			switch cmd.subcommand {
+			case "SLEEP":
+				if len(command) != 3 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				seconds, perr := strconv.ParseFloat(command[2], 64)
+				if perr != nil || seconds < 0 {
+					err = errNotFloat
+					return
+				}
+				cmd.duration = time.Duration(seconds * float64(time.Second))
+			case "POPULATE":
+				if len(command) != 3 && len(command) != 4 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				count, perr := strconv.Atoi(command[2])
+				if perr != nil || count < 0 {
+					err = errNotInteger
+					return
+				}
+				cmd.count = count
+				cmd.key = "key"
+				if len(command) == 4 {
+					cmd.key = command[3]
+				}
+			case "DEL-COUNT":
+				if len(command) < 3 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				cmd.value = append(cmd.value, command[2:]...)
+			case "STRINGMATCH-LEN":
+				if len(command) != 4 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+				cmd.value = append(cmd.value, command[2], command[3])
+			case "HELP":
+				if len(command) != 2 {
+					err = errArity(cmd.command + "|" + cmd.subcommand)
+					return
+				}
+			default:
+				err = errUnknownSubcommand(cmd.command, cmd.subcommand)
+				return
+			}
 		}
 	default:
 		{
-			err = fmt.Errorf("invalid command")
+			err = errUnknownCommand(cmd.command)
 			return err
 		}
 	}
 	return nil
 }
 
+// objectHelp and debugHelp are the OBJECT HELP and DEBUG HELP replies,
+// one subcommand per line.
+var (
+	objectHelp = []string{
+		"OBJECT <subcommand> [<arg> ...]. Subcommands are:",
+		"REFCOUNT <key> -- Return the number of references of the value stored at <key>.",
+		"HELP -- Print this help.",
+	}
+	debugHelp = []string{
+		"DEBUG <subcommand> [<arg> ...]. Subcommands are:",
+		"SLEEP <seconds> -- Stop this connection for <seconds>, which may be fractional.",
+		"POPULATE <count> [<prefix>] -- Create <count> keys named <prefix>:<n> (default prefix \"key\").",
+		"DEL-COUNT <key> [<key> ...] -- Delete the keys and return how many elements they held (a hash counts fields and values).",
+		"STRINGMATCH-LEN <pattern> <string> -- Return 1 if <string> matches the glob <pattern>, 0 otherwise.",
+		"HELP -- Print this help.",
+	}
+)
+
+// requestOverhead is the room left on a request line for the command
+// name and key around a value of -maxvalue bytes.
+const requestOverhead = 1024
+
+// errLineTooLong is returned by readLine when a request line goes past
+// its limit. The remainder of the line has already been discarded, so
+// the connection is ready for the next request.
+var errLineTooLong = errors.New("request line too long")
+
+// readLine reads a single request line from r. Once the line grows past
+// limit bytes (when limit > 0) the rest of it is read and dropped rather
+// than buffered. A final line without a trailing newline is still
+// returned before io.EOF.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if limit > 0 && len(line)+len(chunk) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if tooLong {
+			return "", errLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+// rateLimiter is a token bucket admitting rate commands per second, with
+// bursts of up to rate. Each connection has its own, so it is not safe
+// for concurrent use.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a command arriving at now may run, taking a token
+// if so. A rate of zero or less admits everything.
+func (l *rateLimiter) allow(rate int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	l.last = now
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// hasLine reports whether r already holds a complete request line, so
+// reading it won't block.
+func hasLine(r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// replyWriter is where serveConn writes a connection's replies.
+type replyWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// handleConn serves the requests on conn. Replies are buffered and
+// flushed once every pipelined request that has already arrived is
+// answered, so a pipeline costs one write instead of one per reply. A
+// partial request doesn't count: reading the rest of it may block, so
+// the replies go out first.
 func handleConn(conn net.Conn, c *Redis) {
+	serveConn(conn, c, bufio.NewWriter(conn))
+}
+
+// serveConn runs the request loop of handleConn, writing replies to w.
+func serveConn(conn net.Conn, c *Redis, w replyWriter) {
 	defer conn.Close()
 
-	buffer := make([]byte, 64)
-	_, err := conn.Read(buffer)
+	// user is the ACL identity this connection authenticated as. It stays
+	// nil until a successful AUTH and is only consulted when an ACL file
+	// was loaded.
+	var user *aclUser
 
-	if err != nil {
-		log.Printf("error reading from connection: %s\n", err)
-		return
-	}
+	var limiter rateLimiter
 
-	buff := string(buffer)
-	cmd := RedisCommand{}
-	err = cmd.parse(buff)
-	if err != nil {
-		conn.Write([]byte("Invalid command\n"))
-		return
+	id := c.lastClientID.Add(1)
+	client := &clientConn{conn: conn}
+	c.clientsMu.Lock()
+	c.clients[id] = client
+	c.clientsMu.Unlock()
+	defer func() {
+		c.clientsMu.Lock()
+		delete(c.clients, id)
+		c.clientsMu.Unlock()
+	}()
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		cfg := c.config.current()
+		if cfg.tcpKeepAlive > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(time.Duration(cfg.tcpKeepAlive) * time.Second)
+		} else {
+			tcpConn.SetKeepAlive(false)
+		}
+		tcpConn.SetNoDelay(cfg.tcpNoDelay)
 	}
 
-	switch cmd.command {
-	case "PING":
-		{
-			conn.Write([]byte("PONG\n"))
+	reader := bufio.NewReader(conn)
+	for {
+		if !hasLine(reader) {
+			if err := w.Flush(); err != nil {
+				return
+			}
 		}
-	case "GET":
-		{
-			val := c.get(cmd.key)
-			conn.Write([]byte(strings.Join(val, " ")))
+
+		cfg := c.config.current()
+		lineLimit := 0
+		if cfg.maxValue > 0 {
+			lineLimit = cfg.maxValue + requestOverhead
 		}
-	case "SET":
-		{
-			c.set(cmd.key, cmd.value)
-			conn.Write([]byte("OK"))
+		client.idleSince.Store(c.now().UnixNano())
+		buff, err := readLine(reader, lineLimit)
+		client.idleSince.Store(0)
+		if err == errLineTooLong {
+			writeError(w, errValueTooLarge)
+			continue
 		}
-	case "DEL":
-		{
-			c.del(cmd.key)
-			conn.Write([]byte("OK"))
+		if err != nil {
+			// A closed connection was reaped for being idle.
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("error reading from connection: %s\n", err)
+			}
+			return
 		}
-	case "HMSET":
-		{
-			c.set(cmd.key, cmd.value)
-			conn.Write([]byte("OK"))
+
+		if !limiter.allow(cfg.maxCmdsPerSec, c.now()) {
+			writeError(w, errRateLimited)
+			continue
+		}
+
+		cmd := RedisCommand{}
+		err = cmd.parse(buff)
+		if err != nil {
+			writeError(w, err)
+			continue
+		}
+
+		if c.accessLog != nil {
+			// Values are never logged, only what was run against which key.
+			entry := []string{conn.RemoteAddr().String(), cmd.command}
+			for _, field := range []string{cmd.subcommand, cmd.key} {
+				if field != "" {
+					entry = append(entry, field)
+				}
+			}
+			c.accessLog.Println(strings.Join(entry, " "))
+		}
+
+		if cfg.maxValue > 0 && cmd.valueTooLarge(cfg.maxValue) {
+			writeError(w, errValueTooLarge)
+			continue
+		}
+
+		if cfg.maxKeyLen > 0 && cmd.keyTooLong(cfg.maxKeyLen) {
+			writeError(w, errKeyTooLong)
+			continue
+		}
+
+		if cmd.command == "AUTH" {
+			if c.acl == nil {
+				writeError(w, errNoACL)
+				continue
+			}
+			u, ok := c.acl.authenticate(cmd.key, cmd.value[0])
+			if !ok {
+				writeError(w, errWrongPass)
+				continue
+			}
+			user = u
+			w.Write([]byte("OK\n"))
+			continue
+		}
+
+		if c.acl != nil {
+			if user == nil {
+				writeError(w, errNoAuth)
+				continue
+			}
+			if !user.allowed(cmd.command) {
+				writeError(w, errNoPerm(cmd.command))
+				continue
+			}
+		}
+
+		started := c.now()
+		var deadline time.Time
+		if cfg.commandTimeout > 0 {
+			deadline = started.Add(time.Duration(cfg.commandTimeout) * time.Millisecond)
 		}
+		// Run the command in its own function so a panic in one handler
+		// is reported to this client instead of killing the connection.
+		// Every locked section releases c.mu with defer, so the lock is
+		// freed as the panic unwinds.
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("panic running %s: %v\n%s", cmd.command, r, debug.Stack())
+					writeError(w, &commandError{"ERR", fmt.Sprintf("internal error running '%s' command", strings.ToLower(cmd.command))})
+				}
+			}()
+			switch cmd.command {
+			case "PING":
+				{
+					w.Write([]byte("PONG\n"))
+				}
+			case "ECHO":
+				{
+					w.Write([]byte(quoteArg(cmd.value[0]) + "\n"))
+				}
+			case "TIME":
+				{
+					// Unix seconds and the microseconds within that second.
+					now := c.now()
+					w.Write([]byte(fmt.Sprintf("%d %d\n", now.Unix(), now.Nanosecond()/1000)))
+				}
+			case "ROLE":
+				{
+					// There is no replication, so this is always a master at
+					// offset 0 with no replicas.
+					w.Write([]byte("master 0\n"))
+				}
+			case "LOLWUT", "VERSION":
+				{
+					w.Write([]byte(fmt.Sprintf("gocached ver. %s (%s)\n", version, runtime.Version())))
+				}
+			case "GET":
+				{
+					val, ok := c.get(cmd.key)
+					if !ok {
+						// Tell a missing key apart from an empty value.
+						w.Write([]byte(nilReply + "\n"))
+						break
+					}
+					w.Write([]byte(quoteArgs(val) + "\n"))
+				}
+			case "SET":
+				{
+					c.set(cmd.key, cmd.value)
+					w.Write([]byte("OK\n"))
+				}
+			case "DEL":
+				{
+					c.del(cmd.key)
+					w.Write([]byte("OK\n"))
+				}
+			case "HMSET":
+				{
+					c.set(cmd.key, cmd.value)
+					w.Write([]byte("OK\n"))
+				}
+			case "HSETNX":
+				{
+					n := c.hsetnx(cmd.key, cmd.value[0], cmd.value[1])
+					w.Write([]byte(fmt.Sprintf("%d\n", n)))
+				}
+			case "HEXISTS":
+				{
+					if c.hexists(cmd.key, cmd.value[0]) {
+						w.Write([]byte("1\n"))
+					} else {
+						w.Write([]byte("0\n"))
+					}
+				}
+			case "HLEN":
+				{
+					w.Write([]byte(fmt.Sprintf("%d\n", c.hlen(cmd.key))))
+				}
+			case "HSCAN":
+				{
+					pattern := ""
+					if len(cmd.value) > 0 {
+						pattern = cmd.value[0]
+					}
+					next, pairs := c.hscan(cmd.key, cmd.offset, cmd.count, pattern)
+					reply := append([]string{strconv.Itoa(next)}, pairs...)
+					w.Write([]byte(quoteArgs(reply) + "\n"))
+				}
+			case "HMGET":
+				{
+					values := c.hmget(cmd.key, cmd.value)
+					w.Write([]byte(strings.Join(values, " ") + "\n"))
+				}
+			case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
+				{
+					left := cmd.command[0] == 'L'
+					onlyIfExists := strings.HasSuffix(cmd.command, "X")
+					n := c.push(cmd.key, cmd.value, left, onlyIfExists)
+					w.Write([]byte(fmt.Sprintf("%d\n", n)))
+				}
+			case "LPOP", "RPOP":
+				{
+					popped := c.pop(cmd.key, cmd.count, cmd.command == "LPOP")
+					w.Write([]byte(quoteArgs(popped) + "\n"))
+				}
+			case "RPOPLPUSH", "LMOVE":
+				{
+					moved, ok := c.move(cmd.key, cmd.value[0], cmd.from == "LEFT", cmd.to == "LEFT")
+					if !ok {
+						w.Write([]byte("\n"))
+						break
+					}
+					w.Write([]byte(quoteArg(moved) + "\n"))
+				}
+			case "BLPOP", "BRPOP":
+				{
+					// Don't hold earlier replies back while blocked.
+					w.Flush()
+					left := cmd.command == "BLPOP"
+
+					// Watch the connection while blocked, so a client that
+					// disconnects doesn't leave a waiter behind to swallow
+					// the next push.
+					gone := make(chan struct{})
+					watched := make(chan struct{})
+					go func() {
+						defer close(watched)
+						if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+							close(gone)
+						}
+					}()
+					// Stop the watcher before the reader is used again,
+					// even if the pop panics.
+					defer func() {
+						conn.SetReadDeadline(time.Now())
+						<-watched
+						conn.SetReadDeadline(time.Time{})
+					}()
+					key, popped := c.blockingPop(cmd.value, left, cmd.duration, gone)
+
+					if key == "" {
+						w.Write([]byte("\n"))
+						break
+					}
+					w.Write([]byte(quoteArgs([]string{key, popped}) + "\n"))
+					if err := w.Flush(); err != nil {
+						// The client never got the element; put it back
+						// where it came from for the next consumer.
+						c.push(key, []string{popped}, left, false)
+					}
+				}
+			case "CLIENT":
+				{
+					switch cmd.subcommand {
+					case "ID":
+						w.Write([]byte(fmt.Sprintf("%d\n", id)))
+					}
+				}
+			case "FLUSHDB", "FLUSHALL":
+				{
+					// There is a single keyspace, so both flush all of it.
+					c.flush(cmd.subcommand == "ASYNC")
+					w.Write([]byte("OK\n"))
+				}
+			case "SORT":
+				{
+					sorted, err := c.sortList(cmd.key, cmd.alpha, cmd.desc, cmd.offset, cmd.count)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					w.Write([]byte(quoteArgs(sorted) + "\n"))
+				}
+			case "LPOS":
+				{
+					found, err := c.positions(cmd.key, cmd.value[0], cmd.rank, cmd.count, deadline)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					indexes := make([]string, len(found))
+					for i, index := range found {
+						indexes[i] = strconv.Itoa(index)
+					}
+					w.Write([]byte(strings.Join(indexes, " ") + "\n"))
+				}
+			case "LINSERT":
+				{
+					n := c.insert(cmd.key, cmd.value[0], cmd.value[1], cmd.subcommand == "BEFORE")
+					w.Write([]byte(fmt.Sprintf("%d\n", n)))
+				}
+			case "LTRIM":
+				{
+					c.trim(cmd.key, cmd.start, cmd.stop)
+					w.Write([]byte("OK\n"))
+				}
+			case "OBJECT":
+				{
+					switch cmd.subcommand {
+					case "REFCOUNT":
+						n, ok := c.refcount(cmd.key)
+						if !ok {
+							w.Write([]byte("\n"))
+						} else {
+							w.Write([]byte(fmt.Sprintf("%d\n", n)))
+						}
+					case "HELP":
+						w.Write([]byte(strings.Join(objectHelp, "\n") + "\n"))
+					}
+				}
+			case "MEMORY":
+				{
+					switch cmd.subcommand {
+					case "USAGE":
+						n, ok := c.memoryUsage(cmd.key, cmd.count)
+						if !ok {
+							w.Write([]byte("\n"))
+						} else {
+							w.Write([]byte(fmt.Sprintf("%d\n", n)))
+						}
+					case "STATS":
+						stats := c.memoryStats()
+						w.Write([]byte(fmt.Sprintf("keys.count:%d\nkeys.sampled:%d\ndataset.bytes:%d\noverhead.total:%d\nlargest.key:%s\nlargest.key.bytes:%d\n",
+							stats.keys, stats.sampled, stats.datasetBytes, stats.overhead, quoteArg(stats.largestKey), stats.largestBytes)))
+					}
+				}
+			case "SETBIT":
+				{
+					old := c.setBit(cmd.key, cmd.offset, cmd.bit)
+					w.Write([]byte(fmt.Sprintf("%d\n", old)))
+				}
+			case "GETBIT":
+				{
+					bit := c.getBit(cmd.key, cmd.offset)
+					w.Write([]byte(fmt.Sprintf("%d\n", bit)))
+				}
+			case "BITCOUNT":
+				{
+					n, err := c.bitCount(cmd.key, cmd.start, cmd.stop, deadline)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					w.Write([]byte(fmt.Sprintf("%d\n", n)))
+				}
+			case "BITPOS":
+				{
+					pos, err := c.bitPos(cmd.key, cmd.bit, cmd.start, cmd.stop, cmd.explicitEnd, deadline)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					w.Write([]byte(fmt.Sprintf("%d\n", pos)))
+				}
+			case "DUMPALL":
+				{
+					dump, err := c.exportJSON(deadline)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					if len(cmd.value) == 0 {
+						w.Write(append(dump, '\n'))
+						break
+					}
+					path, err := dumpPath(cfg.dumpDir, cmd.value[0])
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					if err := os.WriteFile(path, dump, 0o644); err != nil {
+						writeError(w, err)
+						break
+					}
+					w.Write([]byte("OK\n"))
+				}
+			case "IMPORT":
+				{
+					path, err := dumpPath(cfg.dumpDir, cmd.value[0])
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					dump, err := os.ReadFile(path)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					n, err := c.importJSON(dump, cmd.subcommand == "REPLACE", cfg.maxKeyLen, cfg.maxValue)
+					if err != nil {
+						writeError(w, err)
+						break
+					}
+					w.Write([]byte(fmt.Sprintf("%d\n", n)))
+				}
+			case "CONFIG":
+				{
+					switch cmd.subcommand {
+					case "GET":
+						pairs := c.config.get(cmd.key)
+						if len(pairs) == 0 {
+							w.Write([]byte("\n"))
+						}
+						for _, pair := range pairs {
+							w.Write([]byte(pair[0] + " " + quoteArg(pair[1]) + "\n"))
+						}
+					case "SET":
+						if err := c.config.set(cmd.key, cmd.value[0]); err != nil {
+							writeError(w, err)
+							break
+						}
+						w.Write([]byte("OK\n"))
+					case "REWRITE":
+						if c.configFile == "" {
+							writeError(w, &commandError{"ERR", "The server is running without a config file"})
+							break
+						}
+						if err := c.config.rewrite(c.configFile); err != nil {
+							writeError(w, err)
+							break
+						}
+						w.Write([]byte("OK\n"))
+					}
+				}
+			case "DEBUG":
+				{
+					switch cmd.subcommand {
+					case "SLEEP":
+						// Only this connection's goroutine sleeps. The store
+						// is not touched, so other clients keep being served;
+						// don't take any lock around it.
+						w.Flush()
+						time.Sleep(cmd.duration)
+						w.Write([]byte("OK\n"))
+					case "POPULATE":
+						c.populate(cmd.count, cmd.key)
+						w.Write([]byte("OK\n"))
+					case "DEL-COUNT":
+						w.Write([]byte(fmt.Sprintf("%d\n", c.delCount(cmd.value))))
+					case "STRINGMATCH-LEN":
+						if stringMatch(cmd.value[0], cmd.value[1]) {
+							w.Write([]byte("1\n"))
+						} else {
+							w.Write([]byte("0\n"))
+						}
+					case "HELP":
+						w.Write([]byte(strings.Join(debugHelp, "\n") + "\n"))
+					}
+				}
+			case "INFO":
+				{
+					info := c.info(cmd.subcommand)
+					if info == "" {
+						// Unknown section: still answer so the client isn't left waiting.
+						info = "\n"
+					}
+					w.Write([]byte(info))
+				}
+			}
+		}()
+		c.stats.record(cmd.command, c.now().Sub(started))
 	}
 }
 
-func main() {
-	var cache Redis
-	cache.db = make(map[string][]string)
+// reapIdleClients calls closeIdleClients once a second.
+func reapIdleClients(c *Redis) {
+	for range time.Tick(time.Second) {
+		c.closeIdleClients()
+	}
+}
 
-	Port := 6969
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", Port))
-	if err != nil {
-		log.Fatalf("Could not initialize the server: %s", err)
+// closeIdleClients closes every connection that has been waiting for a
+// request for longer than -idle-timeout. Connections in the middle of a
+// command, such as one blocked in BLPOP, are left alone.
+func (c *Redis) closeIdleClients() {
+	timeout := time.Duration(c.config.current().idleTimeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+	now := c.now().UnixNano()
+	c.clientsMu.Lock()
+	defer c.clientsMu.Unlock()
+	for _, client := range c.clients {
+		if since := client.idleSince.Load(); since != 0 && now-since > int64(timeout) {
+			client.conn.Close()
+		}
+	}
+}
+
+// listenAddrs returns the addresses to listen on for -bind and -port. An
+// empty bind listens on every interface.
+func listenAddrs(bind string, port int) []string {
+	var addrs []string
+	for _, host := range strings.Split(bind, ",") {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSpace(host), strconv.Itoa(port)))
 	}
+	return addrs
+}
 
-	log.Printf("Listening on port %d...\n", Port)
+// acceptConns accepts connections on ln and hands them to the shared
+// connection loop in main, so every bind address is served the same way.
+// It stops once ln is closed.
+func acceptConns(ln net.Listener, conns chan<- net.Conn, c *Redis) {
+	c.listeners.Add(1)
+	defer c.listeners.Add(-1)
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("Could not accept the connection")
 			continue
 		}
-		go handleConn(conn, &cache)
+		conns <- conn
+	}
+}
+
+// healthHandler answers liveness probes: GET /healthz returns 200 while
+// at least one listener is accepting connections and 503 otherwise.
+func healthHandler(c *Redis) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if c.listeners.Load() == 0 {
+			http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	return mux
+}
+
+// serveHealth serves healthHandler on addr.
+func serveHealth(addr string, c *Redis) {
+	log.Printf("Serving health checks on %s...\n", addr)
+	if err := http.ListenAndServe(addr, healthHandler(c)); err != nil {
+		log.Fatalf("Could not serve health checks: %s", err)
+	}
+}
+
+// newRedis returns an empty server using the settings s.
+func newRedis(s settings) *Redis {
+	c := &Redis{
+		db:      make(map[string][]string),
+		waiters: make(map[string][]chan struct{}),
+		clients: make(map[int64]*clientConn),
+		now:     time.Now,
+	}
+	c.config.s = s
+	c.mu.watchdog = func() time.Duration {
+		return time.Duration(c.config.current().lockWatchdog) * time.Millisecond
+	}
+	return c
+}
+
+// parseSettings defines the server's flags on fs and parses args. With
+// -config the file is loaded first and flags given in args override it.
+// It returns the settings and the config file path.
+func parseSettings(fs *flag.FlagSet, args []string) (settings, string, error) {
+	var s settings
+	fs.IntVar(&s.port, "port", 6969, "TCP port to listen on")
+	fs.StringVar(&s.aclFile, "acl-file", "", "path to an ACL file of \"user password commands\" lines")
+	fs.StringVar(&s.bind, "bind", "", "comma-separated addresses to listen on (default all interfaces)")
+	fs.IntVar(&s.maxValue, "maxvalue", 512*1024*1024, "largest value in bytes a write may store (0 for no limit)")
+	fs.BoolVar(&s.caseInsensitiveKeys, "case-insensitive-keys", false, "treat keys that differ only in case as the same key")
+	fs.StringVar(&s.accessLog, "accesslog", "", "append a line per command (time, client, command, key) to this file")
+	fs.StringVar(&s.dumpDir, "dump-dir", "", "directory DUMPALL <file> and IMPORT <file> are confined to (file dumps are off when empty)")
+	fs.StringVar(&s.httpAddr, "http-addr", "", "serve an HTTP /healthz endpoint on this address")
+	fs.IntVar(&s.maxKeyLen, "maxkeylen", 0, "longest key in bytes a write may use (0 for no limit)")
+	fs.IntVar(&s.tcpKeepAlive, "tcp-keepalive", 300, "seconds between TCP keepalive probes on client connections (0 to disable)")
+	fs.BoolVar(&s.tcpNoDelay, "tcp-nodelay", true, "disable Nagle's algorithm on client connections")
+	fs.IntVar(&s.idleTimeout, "idle-timeout", 0, "close connections idle for longer than this many seconds (0 to keep them open)")
+	fs.IntVar(&s.maxCmdsPerSec, "maxcmds-per-sec", 0, "commands per second each connection may send before being rejected (0 for no limit)")
+	fs.IntVar(&s.lockWatchdog, "lock-watchdog-ms", 0, "log a warning when the write lock is held longer than this many milliseconds (0 to disable)")
+	fs.IntVar(&s.commandTimeout, "command-timeout", 0, "milliseconds LPOS, BITCOUNT, BITPOS or DUMPALL may run before it is aborted (0 for no limit)")
+	configFile := fs.String("config", "", "config file of \"name value\" lines to start from; CONFIG REWRITE saves to it")
+	if err := fs.Parse(args); err != nil {
+		return s, "", err
+	}
+
+	if *configFile != "" {
+		// Flags given on the command line win over the file, so note
+		// them before the file overwrites s and apply them again after.
+		explicit := map[string]string{}
+		fs.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = f.Value.String()
+		})
+		if err := loadConfigFile(*configFile, &s); err != nil {
+			return s, "", fmt.Errorf("could not load the config file: %w", err)
+		}
+		for name, value := range explicit {
+			fs.Set(name, value)
+		}
+	}
+	return s, *configFile, nil
+}
+
+func main() {
+	s, configFile, err := parseSettings(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cache := newRedis(s)
+	cache.configFile = configFile
+
+	if s.aclFile != "" {
+		acl, err := loadACL(s.aclFile)
+		if err != nil {
+			log.Fatalf("Could not load the ACL file: %s", err)
+		}
+		cache.acl = acl
+		log.Printf("Loaded %d ACL users from %s\n", len(acl), s.aclFile)
+	}
+
+	if s.accessLog != "" {
+		f, err := os.OpenFile(s.accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Could not open the access log: %s", err)
+		}
+		defer f.Close()
+		cache.accessLog = log.New(f, "", log.LstdFlags)
+	}
+
+	conns := make(chan net.Conn)
+	for _, addr := range listenAddrs(s.bind, s.port) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Could not initialize the server: %s", err)
+		}
+		log.Printf("Listening on %s...\n", addr)
+		go acceptConns(ln, conns, cache)
+	}
+
+	go reapIdleClients(cache)
+
+	if s.httpAddr != "" {
+		go serveHealth(s.httpAddr, cache)
+	}
+
+	for conn := range conns {
+		go handleConn(conn, cache)
 	}
 }
@@ -0,0 +1,1440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer serves c on a loopback port until the test ends and
+// returns the address to dial.
+func startServer(t testing.TB, c *Redis) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) { handleConn(conn, c) })
+}
+
+// listen runs serve on every connection to a loopback port until the
+// test ends and returns the address to dial.
+func listen(t testing.TB, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testClient speaks the line protocol to a test server.
+type testClient struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t testing.TB, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes line as a single request without waiting for the reply.
+func (tc *testClient) send(line string) {
+	tc.t.Helper()
+	if _, err := tc.conn.Write([]byte(line + "\n")); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// line reads one reply line without its newline.
+func (tc *testClient) line() string {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := tc.r.ReadString('\n')
+	if err != nil {
+		tc.t.Fatalf("reading reply: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// do sends line and returns the first line of the reply.
+func (tc *testClient) do(line string) string {
+	tc.t.Helper()
+	tc.send(line)
+	return tc.line()
+}
+
+// expect sends each request in turn and checks its one-line reply.
+func (tc *testClient) expect(pairs ...string) {
+	tc.t.Helper()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if got := tc.do(pairs[i]); got != pairs[i+1] {
+			tc.t.Errorf("%s = %q, want %q", pairs[i], got, pairs[i+1])
+		}
+	}
+}
+
+// eventually fails the test unless cond becomes true within a few
+// seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waiting reports how many blocked pops are registered on key.
+func waiting(c *Redis, key string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.waiters[key])
+}
+
+func TestBlockingPopDelayedPush(t *testing.T) {
+	c := newRedis(settings{})
+	addr := startServer(t, c)
+	blocked, pusher := dial(t, addr), dial(t, addr)
+
+	blocked.send("BLPOP q 0")
+	eventually(t, "BLPOP to block", func() bool { return waiting(c, "q") == 1 })
+	time.Sleep(50 * time.Millisecond)
+	pusher.expect("LPUSH q job", "1")
+	if got := blocked.line(); got != "q job" {
+		t.Errorf("BLPOP = %q, want %q", got, "q job")
+	}
+	pusher.expect("LPOP q", "")
+}
+
+func TestBlockingPopTimeout(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	start := time.Now()
+	client.expect("BRPOP q 0.1", "")
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("BRPOP returned after %s, before its timeout", took)
+	}
+	client.expect("PING", "PONG")
+}
+
+func TestBlockingPopClientDisconnect(t *testing.T) {
+	c := newRedis(settings{})
+	addr := startServer(t, c)
+	blocked, other := dial(t, addr), dial(t, addr)
+
+	blocked.send("BLPOP q 0")
+	eventually(t, "BLPOP to block", func() bool { return waiting(c, "q") == 1 })
+	blocked.conn.Close()
+	eventually(t, "the waiter to go away", func() bool { return waiting(c, "q") == 0 })
+
+	other.expect(
+		"RPUSH q job1", "1",
+		"LPOP q", "job1",
+	)
+}
+
+func TestHscanIteratesLargeHash(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	fields := make([]string, 0, 2*250)
+	for i := 0; i < 250; i++ {
+		fields = append(fields, "f"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	client.expect("HMSET h "+strings.Join(fields, " "), "OK")
+
+	seen := map[string]string{}
+	cursor, calls := "0", 0
+	for {
+		calls++
+		reply := strings.Fields(client.do("HSCAN h " + cursor + " COUNT 20"))
+		cursor = reply[0]
+		for i := 1; i+1 < len(reply); i += 2 {
+			seen[reply[i]] = reply[i+1]
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 250 || seen["f42"] != "v42" {
+		t.Errorf("HSCAN saw %d fields (f42=%q), want 250", len(seen), seen["f42"])
+	}
+	if calls < 2 {
+		t.Errorf("HSCAN finished in %d call, want several", calls)
+	}
+
+	client.expect(
+		"HSCAN h 0 COUNT 1000 MATCH f1?", "0 f10 v10 f11 v11 f12 v12 f13 v13 f14 v14 f15 v15 f16 v16 f17 v17 f18 v18 f19 v19",
+		"HSCAN missing 0", "0",
+		"HSCAN h -1", "-ERR invalid cursor",
+		"HSCAN h 0 COUNT 0", "-ERR syntax error",
+	)
+}
+
+func TestHscanPathologicalMatch(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect("HMSET h "+strings.Repeat("a", 40)+" v", "OK")
+	start := time.Now()
+	client.expect("HSCAN h 0 MATCH "+strings.Repeat("*a", 12)+"b", "0")
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("HSCAN MATCH took %s", took)
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"*l*o", "hello", true},
+		{"*o*l*", "hello", false},
+		{"h**o", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-e]llo", "hcllo", true},
+		{"h[e-a]llo", "hcllo", true},
+		{"h[a-e]llo", "hzllo", false},
+		{"[\\]]", "]", true},
+		{"[a\\-z]", "-", true},
+		{"[a\\-z]", "b", false},
+		{"[abc", "b", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h\\?", "h?", true},
+		{"h\\?", "hx", false},
+		{"\\[a]", "[a]", true},
+		{"ab\\", "ab\\", true},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("stringMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestStringMatchPathological(t *testing.T) {
+	pattern, s := strings.Repeat("*a", 30)+"b", strings.Repeat("a", 100)
+	start := time.Now()
+	if stringMatch(pattern, s) {
+		t.Errorf("stringMatch(%q, %q) = true", pattern, s)
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("stringMatch took %s", took)
+	}
+}
+
+func TestDebugStringMatchLen(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"DEBUG STRINGMATCH-LEN h[a-e]llo hello", "1",
+		"DEBUG STRINGMATCH-LEN h\\*llo hello", "0",
+		"DEBUG STRINGMATCH-LEN a", "-ERR wrong number of arguments for 'debug|stringmatch-len' command",
+	)
+}
+
+func TestRepliesFlushedBeforePartialRequest(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.conn.Write([]byte("PING\r\nPI"))
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := client.r.ReadString('\n')
+	if err != nil || line != "PONG\n" {
+		t.Fatalf("reply before the rest of the request = %q, %v; want PONG", line, err)
+	}
+	client.send("NG")
+	if got := client.line(); got != "PONG" {
+		t.Errorf("second reply = %q, want PONG", got)
+	}
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.send("SET a 1\nGET a\nPING")
+	for _, want := range []string{"OK", "1", "PONG"} {
+		if got := client.line(); got != want {
+			t.Errorf("reply = %q, want %q", got, want)
+		}
+	}
+}
+
+// flushingWriter sends every reply as soon as it is written, as an
+// unbuffered server would.
+type flushingWriter struct {
+	*bufio.Writer
+}
+
+func (f flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.Writer.Write(p)
+	if err == nil {
+		err = f.Writer.Flush()
+	}
+	return n, err
+}
+
+// benchmarkPipeline sends 100 requests in one write and reads the 100
+// replies.
+func benchmarkPipeline(b *testing.B, addr string) {
+	client := dial(b, addr)
+	batch := strings.Repeat("PING\n", 100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		client.conn.Write([]byte(batch))
+		for i := 0; i < 100; i++ {
+			client.r.ReadString('\n')
+		}
+	}
+}
+
+// BenchmarkPipelined and BenchmarkPipelinedUnbuffered compare the same
+// pipeline answered by one buffered write and by one write per reply.
+// BenchmarkRoundTrip is a client that waits for every reply instead.
+// Both servers disable Nagle's algorithm, as the server does by default,
+// so small writes are not held back waiting for ACKs.
+func BenchmarkPipelined(b *testing.B) {
+	benchmarkPipeline(b, startServer(b, newRedis(settings{tcpNoDelay: true})))
+}
+
+func BenchmarkPipelinedUnbuffered(b *testing.B) {
+	c := newRedis(settings{tcpNoDelay: true})
+	benchmarkPipeline(b, listen(b, func(conn net.Conn) {
+		serveConn(conn, c, flushingWriter{bufio.NewWriter(conn)})
+	}))
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	client := dial(b, startServer(b, newRedis(settings{})))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < 100; i++ {
+			client.conn.Write([]byte("PING\n"))
+			client.r.ReadString('\n')
+		}
+	}
+}
+
+func TestDumpFilesConfinedToDumpDir(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"DUMPALL /tmp/gocached-dump.json", "-ERR dump files are disabled, start the server with -dump-dir",
+		"IMPORT /etc/passwd", "-ERR dump files are disabled, start the server with -dump-dir",
+	)
+
+	dir := t.TempDir()
+	client = dial(t, startServer(t, newRedis(settings{dumpDir: dir})))
+	client.expect(
+		"DUMPALL /tmp/gocached-dump.json", "-ERR dump file name must be a relative path inside -dump-dir",
+		"DUMPALL ../dump.json", "-ERR dump file name must be a relative path inside -dump-dir",
+		"IMPORT sub/../../dump.json", "-ERR dump file name must be a relative path inside -dump-dir",
+		"SET a 1", "OK",
+		"DUMPALL dump.json", "OK",
+		"FLUSHALL", "OK",
+		"IMPORT dump.json", "1",
+		"GET a", "1",
+	)
+	if _, err := os.Stat(filepath.Join(dir, "dump.json")); err != nil {
+		t.Errorf("dump not written inside -dump-dir: %v", err)
+	}
+}
+
+func TestImportChecksLimitsAndNulls(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, dump string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(dump), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("long-key.json", `{"`+strings.Repeat("k", 20)+`":["v"]}`)
+	write("big-value.json", `{"k":["`+strings.Repeat("v", 20)+`"]}`)
+	write("null.json", `{"a":["1"],"k":null}`)
+	write("ok.json", `{"a":["1"],"l":["x","y"]}`)
+
+	client := dial(t, startServer(t, newRedis(settings{dumpDir: dir, maxKeyLen: 10, maxValue: 10})))
+	client.expect(
+		"IMPORT long-key.json", "-ERR key exceeds the -maxkeylen limit",
+		"IMPORT big-value.json", "-ERR value exceeds the -maxvalue limit",
+		"IMPORT null.json", "-ERR dump has no value for key 'k'",
+		"GET a", "(nil)",
+		"IMPORT ok.json", "2",
+		"LPOP l 2", "x y",
+	)
+}
+
+func TestPanickingHandlerReleasesLock(t *testing.T) {
+	c := newRedis(settings{})
+	// Registering a blocked pop in a nil map panics while c.mu is held.
+	c.waiters = nil
+	addr := startServer(t, c)
+	client, other := dial(t, addr), dial(t, addr)
+
+	client.expect(
+		"BLPOP q 0", "-ERR internal error running 'blpop' command",
+		"PING", "PONG",
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if got := other.do("SET a 1"); got != "OK" {
+			t.Errorf("SET after the panic = %q, want OK", got)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("SET after the panic blocked: the lock was left held")
+	}
+}
+
+func TestQuotedArguments(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"ECHO a b", "-ERR wrong number of arguments for 'echo' command",
+		`SET k "unterminated`, "-ERR Protocol error: unbalanced quotes in request",
+		`SET k "a"b`, "-ERR Protocol error: unbalanced quotes in request",
+		"SET \t k  \t 1 \r", "OK",
+		"GET k", "1",
+	)
+	for _, tt := range []struct {
+		arg  string
+		want string
+	}{
+		{`"line1\nline2"`, "line1\nline2"},
+		{`"a   b"`, "a   b"},
+		{`'it\'s \n raw'`, `it's \n raw`},
+		{`"\x41\x4"`, "Ax4"},
+		{`""`, ""},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"\x00\r\t\x7f"`, "\x00\r\t\x7f"},
+		{`"(nil)"`, "(nil)"},
+		{`back\slash`, `back\slash`},
+	} {
+		// GET and PING in one write: GET must answer on exactly one line
+		// for PING's reply to follow it.
+		client.expect("SET k "+tt.arg, "OK")
+		client.send("GET k\nPING")
+		reply := client.line()
+		if got, err := splitArgs(reply); err != nil || len(got) != 1 || got[0] != tt.want {
+			t.Errorf("GET k after SET k %s = %q, reads back as %q (%v), want %q", tt.arg, reply, got, err, tt.want)
+		}
+		if got := client.line(); got != "PONG" {
+			t.Fatalf("reply after GET k = %q, want PONG", got)
+		}
+	}
+}
+
+func TestQuotedReplies(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		`HMSET h "f g" "v w" e ""`, "OK",
+		`RPUSH l "a b" "" c`, "3",
+	)
+	for _, tt := range []struct {
+		command string
+		want    []string
+	}{
+		{"HSCAN h 0", []string{"0", "f g", "v w", "e", ""}},
+		{`HMGET h "f g" nosuch e`, []string{"v w", "(nil)", ""}},
+		{"SORT l ALPHA", []string{"", "a b", "c"}},
+		{`ECHO "say \"hi\""`, []string{`say "hi"`}},
+		{"RPOPLPUSH l m", []string{"c"}},
+		{"LPOP l 2", []string{"a b", ""}},
+	} {
+		reply := client.do(tt.command)
+		got, err := splitArgs(reply)
+		if err != nil || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s = %q, reads back as %q (%v), want %q", tt.command, reply, got, err, tt.want)
+		}
+	}
+	// The missing field stays the bare nil marker.
+	client.expect(`HMGET h nosuch`, "(nil)")
+	// An error quoting an argument with a newline stays on one line.
+	client.expect(`"bad\ncommand"`, "-ERR unknown command 'bad command'")
+}
+
+func TestQuoteArgRoundTrip(t *testing.T) {
+	var all strings.Builder
+	for b := 0; b < 256; b++ {
+		all.WriteByte(byte(b))
+	}
+	for _, s := range []string{"plain", "", " ", "(nil)", `"`, "'", `'quoted'`, `a\b`, "tab\there", all.String()} {
+		got, err := splitArgs(quoteArg(s))
+		if err != nil || len(got) != 1 || got[0] != s {
+			t.Errorf("splitArgs(quoteArg(%q)) = %q, %v", s, got, err)
+		}
+	}
+	if got := quoteArg("plain"); got != "plain" {
+		t.Errorf("quoteArg(plain) = %q, want it unquoted", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		`ECHO "hello big  world"`, `"hello big  world"`,
+		"ECHO hello", "hello",
+		"ECHO", "-ERR wrong number of arguments for 'echo' command",
+	)
+}
+
+func TestTime(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	reply := strings.Fields(client.do("TIME"))
+	if len(reply) != 2 {
+		t.Fatalf("TIME = %q, want seconds and microseconds", reply)
+	}
+	seconds, err := strconv.ParseInt(reply[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := time.Now().Unix() - seconds; diff < -1 || diff > 1 {
+		t.Errorf("TIME seconds = %d, %ds away from now", seconds, diff)
+	}
+	if usec, err := strconv.Atoi(reply[1]); err != nil || usec < 0 || usec >= 1000000 {
+		t.Errorf("TIME microseconds = %q, want 0-999999", reply[1])
+	}
+}
+
+func TestACLReadOnlyUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	acl := "# test users\nreader secret GET,PING\ndefault admin *\n"
+	if err := os.WriteFile(path, []byte(acl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := newRedis(settings{})
+	var err error
+	if c.acl, err = loadACL(path); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, c)
+
+	reader := dial(t, addr)
+	reader.expect(
+		"GET k", "-NOAUTH Authentication required",
+		"AUTH reader wrong", "-WRONGPASS invalid username-password pair",
+		"AUTH reader secret", "OK",
+		"GET k", "(nil)",
+		"SET k v", "-NOPERM this user has no permissions to run the 'set' command",
+	)
+
+	admin := dial(t, addr)
+	admin.expect(
+		"AUTH admin", "OK",
+		"SET k v", "OK",
+	)
+	reader.expect("GET k", "v")
+}
+
+func TestAuthWithoutACL(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"AUTH secret", "-ERR AUTH called without any ACL configured",
+		"SET k v", "OK",
+	)
+}
+
+func TestListenAddrs(t *testing.T) {
+	tests := []struct {
+		bind string
+		want []string
+	}{
+		{"", []string{":6969"}},
+		{"127.0.0.1", []string{"127.0.0.1:6969"}},
+		{"127.0.0.1, ::1", []string{"127.0.0.1:6969", "[::1]:6969"}},
+	}
+	for _, tt := range tests {
+		if got := listenAddrs(tt.bind, 6969); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("listenAddrs(%q) = %q, want %q", tt.bind, got, tt.want)
+		}
+	}
+}
+
+func TestBindLoopback(t *testing.T) {
+	c := newRedis(settings{})
+	ln, err := net.Listen("tcp", listenAddrs("127.0.0.1", 0)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn)
+	go acceptConns(ln, conns, c)
+	go func() {
+		for conn := range conns {
+			go handleConn(conn, c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	client := dial(t, ln.Addr().String())
+	client.expect("PING", "PONG")
+	if n := c.listeners.Load(); n != 1 {
+		t.Errorf("listeners = %d, want 1", n)
+	}
+}
+
+func TestMaxValue(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{maxValue: 10})))
+	client.expect(
+		"SET k "+strings.Repeat("v", 10), "OK",
+		"SET k "+strings.Repeat("v", 11), "-ERR value exceeds the -maxvalue limit",
+		"RPUSH l a "+strings.Repeat("v", 11), "-ERR value exceeds the -maxvalue limit",
+		"SETBIT b 80 1", "-ERR value exceeds the -maxvalue limit",
+		// A line too long to even parse is dropped as it is read, and
+		// the connection keeps working.
+		"SET k "+strings.Repeat("v", 10+requestOverhead+1), "-ERR value exceeds the -maxvalue limit",
+		"GET k", strings.Repeat("v", 10),
+	)
+}
+
+func TestDebugSleep(t *testing.T) {
+	addr := startServer(t, newRedis(settings{}))
+	sleeper, other := dial(t, addr), dial(t, addr)
+
+	start := time.Now()
+	sleeper.send("DEBUG SLEEP 0.2")
+	// Other clients are served while one sleeps.
+	other.expect("PING", "PONG")
+	if took := time.Since(start); took >= 200*time.Millisecond {
+		t.Errorf("PING waited %s for another client's DEBUG SLEEP", took)
+	}
+	if got := sleeper.line(); got != "OK" {
+		t.Errorf("DEBUG SLEEP = %q, want OK", got)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("DEBUG SLEEP 0.2 replied after %s", took)
+	}
+	sleeper.expect("DEBUG SLEEP -1", "-ERR value is not a valid float")
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{caseInsensitiveKeys: true})))
+	client.expect(
+		"SET Foo bar", "OK",
+		"GET foo", "bar",
+		"RPUSH List a", "1",
+		"RPUSH LIST b", "2",
+		"GET list", "a b",
+	)
+
+	client = dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"SET Foo bar", "OK",
+		"GET foo", "(nil)",
+		"GET Foo", "bar",
+	)
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c := newRedis(settings{})
+	c.accessLog = log.New(f, "", log.LstdFlags)
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"SET greeting topsecret", "OK",
+		"GET greeting", "topsecret",
+		"CLIENT ID", "1",
+	)
+
+	logged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SET greeting", "GET greeting", "CLIENT ID"} {
+		if !strings.Contains(string(logged), want) {
+			t.Errorf("access log is missing %q:\n%s", want, logged)
+		}
+	}
+	if strings.Contains(string(logged), "topsecret") {
+		t.Errorf("access log contains a value:\n%s", logged)
+	}
+}
+
+func TestPushX(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"LPUSHX l a", "0",
+		"RPUSHX l a", "0",
+		"GET l", "(nil)",
+		"RPUSH l b", "1",
+		"LPUSHX l a", "2",
+		"RPUSHX l c d", "4",
+		"GET l", "a b c d",
+	)
+}
+
+func TestPopCount(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"RPUSH l a b c d", "4",
+		"LPOP l 2", "a b",
+		"RPOP l 5", "d c",
+		"GET l", "(nil)",
+		"LPOP l 1", "",
+		"RPOP l -1", "-ERR value is not an integer or out of range",
+	)
+}
+
+func TestPopDoesNotShareBackingArray(t *testing.T) {
+	c := newRedis(settings{})
+	c.push("l", []string{"a", "b", "c", "d", "e"}, false, false)
+	held, _ := c.get("l")
+	c.pop("l", 1, false)
+	c.push("l", []string{"X"}, false, false)
+	if got := strings.Join(held, " "); got != "a b c d e" {
+		t.Errorf("value returned by get changed to %q after RPOP and RPUSH", got)
+	}
+}
+
+func TestMoveBetweenLists(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"RPUSH src a b c", "3",
+		"RPUSH dst x", "1",
+		"RPOPLPUSH src dst", "c",
+		"GET src", "a b",
+		"GET dst", "c x",
+		"LMOVE src dst LEFT RIGHT", "a",
+		"GET src", "b",
+		"GET dst", "c x a",
+		"LMOVE src src LEFT LEFT", "b",
+		"GET src", "b",
+		"LMOVE src dst RIGHT LEFT", "b",
+		"GET src", "(nil)",
+		"RPOPLPUSH src dst", "",
+		"LMOVE src dst UP LEFT", "-ERR syntax error",
+	)
+}
+
+func TestClientID(t *testing.T) {
+	addr := startServer(t, newRedis(settings{}))
+	first, second := dial(t, addr), dial(t, addr)
+	a, err := strconv.Atoi(first.do("CLIENT ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := strconv.Atoi(second.do("CLIENT ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b <= a {
+		t.Errorf("CLIENT ID = %d then %d, want increasing IDs", a, b)
+	}
+	first.expect("CLIENT ID", strconv.Itoa(a))
+}
+
+func TestFlushAsync(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"DEBUG POPULATE 10000", "OK",
+		"FLUSHALL ASYNC", "OK",
+		"GET key:1", "(nil)",
+		"SET a 1", "OK",
+		"FLUSHDB", "OK",
+		"GET a", "(nil)",
+		"FLUSHALL LATER", "-ERR syntax error",
+	)
+	if n := c.dbSize(); n != 0 {
+		t.Errorf("%d keys left after flushing", n)
+	}
+}
+
+func TestLpos(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"RPUSH l a b c a b c a", "7",
+		"LPOS l a", "0",
+		"LPOS l a COUNT 0", "0 3 6",
+		"LPOS l a COUNT 2", "0 3",
+		"LPOS l a RANK 2", "3",
+		"LPOS l a RANK -1", "6",
+		"LPOS l a RANK -2 COUNT 2", "3 0",
+		"LPOS l z", "",
+		"LPOS l a RANK 0", "-ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list",
+		"LPOS l a COUNT -1", "-ERR COUNT can't be negative",
+	)
+}
+
+func TestLinsert(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"LINSERT l BEFORE a x", "0",
+		"RPUSH l a b c", "3",
+		"LINSERT l BEFORE b x", "4",
+		"LINSERT l AFTER c y", "5",
+		"GET l", "a x b c y",
+		"LINSERT l AFTER z w", "-1",
+		"LINSERT l AROUND a w", "-ERR syntax error",
+	)
+}
+
+func TestLtrim(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"RPUSH l a b c d e", "5",
+		"LTRIM l 1 -2", "OK",
+		"GET l", "b c d",
+		"LTRIM l 1 100", "OK",
+		"GET l", "c d",
+		"LTRIM l 5 1", "OK",
+		"GET l", "(nil)",
+	)
+}
+
+func TestMaxKeyLen(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{maxKeyLen: 5})))
+	client.expect(
+		"SET abcde v", "OK",
+		"SET abcdef v", "-ERR key exceeds the -maxkeylen limit",
+		"RPUSH abcdef v", "-ERR key exceeds the -maxkeylen limit",
+		"RPUSH l v", "1",
+		"RPOPLPUSH l abcdef", "-ERR key exceeds the -maxkeylen limit",
+		"GET abcdef", "(nil)",
+	)
+}
+
+func TestSharedIntegers(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"SET a 42", "OK",
+		"SET b 42", "OK",
+		"SET c 042", "OK",
+		"SET d 10000", "OK",
+		"OBJECT REFCOUNT a", strconv.Itoa(sharedRefcount),
+		"OBJECT REFCOUNT c", "1",
+		"OBJECT REFCOUNT d", "1",
+		"OBJECT REFCOUNT missing", "",
+	)
+	a, _ := c.get("a")
+	b, _ := c.get("b")
+	if &a[0] != &b[0] {
+		t.Error("keys set to the same small integer don't share a value")
+	}
+}
+
+// benchmarkSetIntegers sets b.N keys to integers from base up and
+// reports the heap each key keeps.
+func benchmarkSetIntegers(b *testing.B, base int) {
+	c := newRedis(settings{})
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i, key := range keys {
+		c.set(key, []string{strconv.Itoa(base + i%1000)})
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-B/key")
+	runtime.KeepAlive(c)
+}
+
+func BenchmarkSetSharedIntegers(b *testing.B)   { benchmarkSetIntegers(b, 0) }
+func BenchmarkSetUnsharedIntegers(b *testing.B) { benchmarkSetIntegers(b, sharedIntegersCount) }
+
+func TestCommandStats(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	for i := 0; i < 7; i++ {
+		client.expect("SET k "+strconv.Itoa(i), "OK")
+	}
+	client.send("INFO commandstats")
+	if got := client.line(); got != "# Commandstats" {
+		t.Fatalf("INFO commandstats header = %q", got)
+	}
+	if got := client.line(); !strings.HasPrefix(got, "cmdstat_set:calls=7,") {
+		t.Errorf("INFO commandstats = %q, want cmdstat_set:calls=7", got)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"SET small v", "OK",
+		"SET large "+strings.Repeat("v", 1000), "OK",
+		"MEMORY USAGE missing", "",
+		"MEMORY USAGE small SAMPLE 1", "-ERR syntax error",
+	)
+	small, err := strconv.Atoi(client.do("MEMORY USAGE small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := strconv.Atoi(client.do("MEMORY USAGE large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if large-small < 999 {
+		t.Errorf("MEMORY USAGE small = %d, large = %d; want large at least 999 bytes more", small, large)
+	}
+}
+
+func TestMemoryUsageSampling(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	elements := make([]string, 2000)
+	for i := range elements {
+		elements[i] = fmt.Sprintf("element-%04d", i)
+	}
+	client.expect("RPUSH l "+strings.Join(elements, " "), "2000")
+
+	exact, err := strconv.Atoi(client.do("MEMORY USAGE l SAMPLES 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, samples := range []string{"", " SAMPLES 5", " SAMPLES 100"} {
+		sampled, err := strconv.Atoi(client.do("MEMORY USAGE l" + samples))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := sampled - exact; diff < -exact/20 || diff > exact/20 {
+			t.Errorf("MEMORY USAGE l%s = %d, more than 5%% off the exact %d", samples, sampled, exact)
+		}
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect("DEBUG POPULATE 1500", "OK")
+	client.send("MEMORY STATS")
+	stats := map[string]string{}
+	for i := 0; i < 6; i++ {
+		name, value, _ := strings.Cut(client.line(), ":")
+		stats[name] = value
+	}
+	if want := strconv.Itoa(c.dbSize()); stats["keys.count"] != want {
+		t.Errorf("keys.count = %q, want %s", stats["keys.count"], want)
+	}
+	if stats["keys.sampled"] != strconv.Itoa(memoryStatsSamples) {
+		t.Errorf("keys.sampled = %q, want %d", stats["keys.sampled"], memoryStatsSamples)
+	}
+	if !strings.HasPrefix(stats["largest.key"], "key:") {
+		t.Errorf("largest.key = %q", stats["largest.key"])
+	}
+}
+
+func TestRole(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect("ROLE", "master 0")
+}
+
+func TestSetBitGetBit(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"SETBIT b 7 1", "0",
+		"GET b", `"\x01"`,
+		"SETBIT b 8000 1", "0",
+		"SETBIT b 8000 0", "1",
+		"GETBIT b 7", "1",
+		"GETBIT b 6", "0",
+		"GETBIT b 100000", "0",
+		"GETBIT missing 0", "0",
+		"SETBIT b 0 2", "-ERR bit is not an integer or out of range",
+		"SETBIT b -1 1", "-ERR bit offset is not an integer or out of range",
+	)
+	if b, _ := c.get("b"); len(b) != 1 || len(b[0]) != 1001 {
+		t.Errorf("after SETBIT b 8000 the value is %d bytes, want 1001", len(strings.Join(b, " ")))
+	}
+}
+
+func TestBitCount(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"SET k foobar", "OK",
+		"BITCOUNT k", "26",
+		"BITCOUNT k 0 0", "4",
+		"BITCOUNT k 1 1", "6",
+		"BITCOUNT k -2 -1", "7",
+		"BITCOUNT k 4 2", "0",
+		"BITCOUNT k 0 100", "26",
+		"BITCOUNT missing", "0",
+		"BITCOUNT k 0", "-ERR syntax error",
+	)
+}
+
+func TestBitPos(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		`SET k "\xff\xf0\x00"`, "OK",
+		"BITPOS k 0", "12",
+		"BITPOS k 1 2", "-1",
+		"BITPOS k 1 1", "8",
+		"BITPOS k 0 0 0", "-1",
+		`SET ones "\xff\xff"`, "OK",
+		// With no end given, the string counts as padded with zeros.
+		"BITPOS ones 0", "16",
+		"BITPOS ones 0 0 -1", "-1",
+		"BITPOS missing 0", "0",
+		"BITPOS missing 1", "-1",
+		"BITPOS k 2", "-ERR bit is not an integer or out of range",
+	)
+}
+
+func TestVersionBanner(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	for _, command := range []string{"LOLWUT", "VERSION"} {
+		if got := client.do(command); !strings.Contains(got, "ver. "+version) {
+			t.Errorf("%s = %q, want it to contain version %s", command, got, version)
+		}
+	}
+}
+
+func TestErrorPrefixes(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"GET", "-ERR wrong number of arguments for 'get' command",
+		"OBJECT REFCOUNT", "-ERR wrong number of arguments for 'object|refcount' command",
+		"NOSUCH", "-ERR unknown command 'NOSUCH'",
+		"OBJECT NOSUCH k", "-ERR unknown subcommand 'NOSUCH' for 'object'",
+		"LPOP l x", "-ERR value is not an integer or out of range",
+		"BLPOP l x", "-ERR timeout is not a float or out of range",
+		"", "-ERR empty command",
+	)
+}
+
+func TestConfigGetSet(t *testing.T) {
+	c := newRedis(settings{maxValue: 100, port: 6969})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"CONFIG GET maxvalue", "maxvalue 100",
+		"CONFIG SET maxvalue 5", "OK",
+		"CONFIG GET maxvalue", "maxvalue 5",
+		"SET k 123456", "-ERR value exceeds the -maxvalue limit",
+		"CONFIG SET maxvalue -1", "-ERR CONFIG SET failed (possibly related to argument 'maxvalue') - argument must be a non-negative integer",
+		"CONFIG SET port 1", "-ERR CONFIG SET failed - 'port' can't be changed at runtime",
+		"CONFIG SET nosuch 1", "-ERR Unsupported CONFIG parameter: nosuch",
+		"CONFIG GET nosuch", "",
+	)
+	if got := c.config.current().maxValue; got != 5 {
+		t.Errorf("maxValue = %d after CONFIG SET, want 5", got)
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocached.conf")
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect("CONFIG REWRITE", "-ERR The server is running without a config file")
+
+	c := newRedis(settings{port: 6969, maxKeyLen: 10})
+	c.configFile = path
+	client = dial(t, startServer(t, c))
+	client.expect(
+		"CONFIG SET maxkeylen 256", "OK",
+		"CONFIG REWRITE", "OK",
+	)
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(written), "\nmaxkeylen 256\n") {
+		t.Errorf("rewritten config lacks maxkeylen 256:\n%s", written)
+	}
+
+	var s settings
+	if err := loadConfigFile(path, &s); err != nil {
+		t.Fatalf("loading the rewritten file: %v", err)
+	}
+	if s.maxKeyLen != 256 || s.port != 6969 {
+		t.Errorf("rewritten file loads maxkeylen %d, port %d; want 256, 6969", s.maxKeyLen, s.port)
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocached.conf")
+	if err := os.WriteFile(path, []byte("# test\nport 7000\nmaxvalue 123\nmaxkeylen 9\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, configFile, err := parseSettings(flag.NewFlagSet("gocached", flag.ContinueOnError), []string{"-config", path, "-maxkeylen", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configFile != path {
+		t.Errorf("config file = %q, want %q", configFile, path)
+	}
+	if s.port != 7000 || s.maxValue != 123 {
+		t.Errorf("port %d, maxvalue %d; want 7000, 123 from the file", s.port, s.maxValue)
+	}
+	if s.maxKeyLen != 4 {
+		t.Errorf("maxkeylen = %d, want the -maxkeylen flag's 4 over the file's 9", s.maxKeyLen)
+	}
+
+	if err := os.WriteFile(path, []byte("nosuch 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseSettings(flag.NewFlagSet("gocached", flag.ContinueOnError), []string{"-config", path}); err == nil {
+		t.Error("parseSettings accepted a config file with an unknown parameter")
+	}
+}
+
+func TestHsetnx(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"HSETNX h f one", "1",
+		"HSETNX h f two", "0",
+		"HSETNX h g three", "1",
+		"HMGET h f g", "one three",
+		"HSETNX h", "-ERR wrong number of arguments for 'hsetnx' command",
+	)
+}
+
+func TestHmget(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"HMSET h a 1 b 2", "OK",
+		"HMGET h a nosuch b", "1 (nil) 2",
+		"HMGET nosuch a b", "(nil) (nil)",
+		"HMGET h", "-ERR wrong number of arguments for 'hmget' command",
+	)
+}
+
+func TestHexistsHlen(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"HMSET h a 1 b 2", "OK",
+		"HEXISTS h a", "1",
+		"HEXISTS h nosuch", "0",
+		"HEXISTS nosuch a", "0",
+		"HLEN h", "2",
+		"HLEN nosuch", "0",
+	)
+}
+
+func TestDebugPopulate(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"SET key:5 mine", "OK",
+		"DEBUG POPULATE 1000", "OK",
+		"GET key:0", "value:0",
+		"GET key:999", "value:999",
+		"GET key:5", "mine",
+		"DEBUG POPULATE 3 item", "OK",
+		"GET item:2", "value:2",
+		"DEBUG POPULATE -1", "-ERR value is not an integer or out of range",
+	)
+	if n := c.dbSize(); n != 1003 {
+		t.Errorf("dbSize = %d after populating 1000 and 3 keys, want 1003", n)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	c := newRedis(settings{commandTimeout: 1})
+	// Every reading of the clock is a millisecond after the last, so
+	// a scan passes its deadline at the first check.
+	var ticks atomic.Int64
+	start := time.Now()
+	c.now = func() time.Time {
+		return start.Add(time.Duration(ticks.Add(1)) * time.Millisecond)
+	}
+	c.set("big", make([]string, 10*deadlineCheckInterval))
+	c.set("bits", []string{strings.Repeat("\x00", 10*deadlineCheckInterval)})
+	c.populate(10*deadlineCheckInterval, "key")
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"LPOS big x", "-ERR command exceeded the -command-timeout limit",
+		"BITCOUNT bits", "-ERR command exceeded the -command-timeout limit",
+		"BITPOS bits 1", "-ERR command exceeded the -command-timeout limit",
+		"DUMPALL", "-ERR command exceeded the -command-timeout limit",
+		"CONFIG SET command-timeout 0", "OK",
+		"LPOS big x", "",
+		"BITCOUNT bits", "0",
+		"BITPOS bits 1", "-1",
+	)
+
+	// Encoding key by key gives the same dump as marshaling the map.
+	dump, err := c.exportJSON(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(c.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dump) != string(want) {
+		t.Error("exportJSON differs from json.Marshal of the keyspace")
+	}
+}
+
+func TestSort(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"RPUSH n 10 2 -3 1.5", "4",
+		"SORT n", "-3 1.5 2 10",
+		"SORT n DESC", "10 2 1.5 -3",
+		"SORT n LIMIT 1 2", "1.5 2",
+		"SORT n DESC LIMIT 0 1", "10",
+		"RPUSH s b c a 10", "4",
+		"SORT s", "-ERR One or more scores can't be converted into double",
+		"SORT s ALPHA", "10 a b c",
+		"SORT s ALPHA DESC LIMIT 1 -1", "b a 10",
+		"SORT n BY", "-ERR syntax error",
+		"LPOP n 4", "10 2 -3 1.5",
+	)
+}
+
+func TestLockWatchdog(t *testing.T) {
+	var logged strings.Builder
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	c := newRedis(settings{})
+	c.populate(200000, "key")
+	if logged.Len() != 0 {
+		t.Errorf("watchdog logged with lock-watchdog-ms 0:\n%s", logged.String())
+	}
+
+	c = newRedis(settings{lockWatchdog: 1})
+	c.populate(200000, "key")
+	if !strings.Contains(logged.String(), "WARNING: (*Redis).populate held the write lock for ") {
+		t.Errorf("no watchdog warning naming populate, logged:\n%s", logged.String())
+	}
+}
+
+func TestInjectedClock(t *testing.T) {
+	c := newRedis(settings{})
+	var now atomic.Int64
+	now.Store(time.Unix(1700000000, 123456789).UnixNano())
+	c.now = func() time.Time { return time.Unix(0, now.Load()) }
+	client := dial(t, startServer(t, c))
+	client.expect("TIME", "1700000000 123456")
+	now.Add(int64(90 * time.Second))
+	client.expect("TIME", "1700000090 123456")
+}
+
+func TestHelp(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	for _, tc := range []struct {
+		command     string
+		lines       int
+		subcommands []string
+	}{
+		{"OBJECT HELP", 3, []string{"REFCOUNT", "HELP"}},
+		{"DEBUG HELP", 6, []string{"SLEEP", "POPULATE", "DEL-COUNT", "STRINGMATCH-LEN", "HELP"}},
+	} {
+		client.send(tc.command)
+		var help []string
+		for i := 0; i < tc.lines; i++ {
+			help = append(help, client.line())
+		}
+		for _, sub := range tc.subcommands {
+			found := false
+			for _, line := range help[1:] {
+				found = found || strings.HasPrefix(line, sub+" ")
+			}
+			if !found {
+				t.Errorf("%s does not describe %s:\n%s", tc.command, sub, strings.Join(help, "\n"))
+			}
+		}
+		// The help must end where it says it does.
+		client.expect("ECHO next", "next")
+	}
+}
+
+func TestGetMissingKey(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.expect(
+		"GET nosuch", "(nil)",
+		`SET empty ""`, "OK",
+		"GET empty", `""`,
+	)
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	client := dial(t, startServer(t, newRedis(settings{})))
+	client.send("INFO keyspace")
+	if got := client.line(); got != "# Keyspace" {
+		t.Fatalf("INFO keyspace header = %q", got)
+	}
+	// An empty keyspace has no db0 line, so the next reply follows.
+	client.expect(
+		"ECHO next", "next",
+		"DEBUG POPULATE 5", "OK",
+		"SET k v", "OK",
+	)
+	client.send("INFO keyspace")
+	if got := client.line(); got != "# Keyspace" {
+		t.Fatalf("INFO keyspace header = %q", got)
+	}
+	if got := client.line(); got != "db0:keys=6,expires=0" {
+		t.Errorf("INFO keyspace = %q, want db0:keys=6,expires=0", got)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow(3, start) {
+			t.Fatalf("command %d of a burst of 3 was rejected", i+1)
+		}
+	}
+	if l.allow(3, start) {
+		t.Error("a 4th command in the same instant was allowed at 3 per second")
+	}
+	if !l.allow(3, start.Add(400*time.Millisecond)) {
+		t.Error("no token refilled after 400ms")
+	}
+	if l.allow(3, start.Add(400*time.Millisecond)) {
+		t.Error("more than one token refilled after 400ms")
+	}
+	if !l.allow(0, start) {
+		t.Error("a rate of 0 rejected a command")
+	}
+}
+
+func TestMaxCmdsPerSec(t *testing.T) {
+	c := newRedis(settings{maxCmdsPerSec: 3})
+	var now atomic.Int64
+	now.Store(time.Now().UnixNano())
+	c.now = func() time.Time { return time.Unix(0, now.Load()) }
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"ECHO 1", "1",
+		"ECHO 2", "2",
+		"ECHO 3", "3",
+		"ECHO 4", "-ERR max number of commands per second exceeded",
+	)
+	now.Add(int64(time.Second))
+	client.expect("ECHO 5", "5")
+
+	// Each connection has its own budget.
+	dial(t, startServer(t, c)).expect("ECHO other", "other")
+}
+
+func TestDebugDelCount(t *testing.T) {
+	c := newRedis(settings{})
+	client := dial(t, startServer(t, c))
+	client.expect(
+		"RPUSH l a b c", "3",
+		"HMSET h f1 v1 f2 v2", "OK",
+		"SET s v", "OK",
+		"SET kept v", "OK",
+		// 3 list elements, the hash's 2 fields and 2 values, 1 string.
+		"DEBUG DEL-COUNT l h s nosuch", "8",
+		"GET s", "(nil)",
+		"DEBUG DEL-COUNT l", "0",
+	)
+	if n := c.dbSize(); n != 1 {
+		t.Errorf("dbSize = %d after deleting all but one key, want 1", n)
+	}
+}
+
+// idleClients reports how many connections are waiting for a request.
+func idleClients(c *Redis) int {
+	c.clientsMu.Lock()
+	defer c.clientsMu.Unlock()
+	idle := 0
+	for _, client := range c.clients {
+		if client.idleSince.Load() != 0 {
+			idle++
+		}
+	}
+	return idle
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := newRedis(settings{idleTimeout: 10})
+	var now atomic.Int64
+	now.Store(time.Now().UnixNano())
+	c.now = func() time.Time { return time.Unix(0, now.Load()) }
+	addr := startServer(t, c)
+	idle, blocked := dial(t, addr), dial(t, addr)
+
+	blocked.send("BLPOP q 0")
+	eventually(t, "BLPOP to block", func() bool { return waiting(c, "q") == 1 })
+	idle.expect("PING", "PONG")
+	eventually(t, "the idle client to wait", func() bool { return idleClients(c) == 1 })
+
+	now.Add(int64(5 * time.Second))
+	c.closeIdleClients()
+	idle.expect("PING", "PONG")
+	eventually(t, "the idle client to wait", func() bool { return idleClients(c) == 1 })
+
+	now.Add(int64(11 * time.Second))
+	c.closeIdleClients()
+	idle.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := idle.r.ReadString('\n'); err != io.EOF {
+		t.Errorf("idle client read %q, %v; want EOF once reaped", line, err)
+	}
+
+	dial(t, addr).expect("LPUSH q job", "1")
+	if got := blocked.line(); got != "q job" {
+		t.Errorf("BLPOP = %q after the reap, want %q", got, "q job")
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	c := newRedis(settings{})
+	health := healthHandler(c)
+	status := func() int {
+		rec := httptest.NewRecorder()
+		health.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/healthz = %d before listening, want 503", got)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		acceptConns(ln, make(chan net.Conn), c)
+		close(stopped)
+	}()
+	eventually(t, "the listener to be counted", func() bool { return status() == http.StatusOK })
+
+	ln.Close()
+	<-stopped
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/healthz = %d after the listener closed, want 503", got)
+	}
+}
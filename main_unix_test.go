@@ -0,0 +1,82 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// serveOne accepts a single connection for c and returns the server's
+// side of it along with a client connected to it.
+func serveOne(t *testing.T, c *Redis) (*net.TCPConn, *testClient) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+		handleConn(conn, c)
+	}()
+	client := dial(t, ln.Addr().String())
+	conn, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	// A reply means handleConn has set up the connection.
+	client.expect("PING", "PONG")
+	return conn.(*net.TCPConn), client
+}
+
+// sockopt reads an integer socket option from conn.
+func sockopt(t *testing.T, conn *net.TCPConn, level, name int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	conn, _ := serveOne(t, newRedis(settings{tcpKeepAlive: 60}))
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Error("keepalive is off with -tcp-keepalive 60")
+	}
+
+	conn, _ = serveOne(t, newRedis(settings{tcpKeepAlive: 0}))
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Error("keepalive is on with -tcp-keepalive 0")
+	}
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	conn, _ := serveOne(t, newRedis(settings{tcpNoDelay: true}))
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("TCP_NODELAY is off with -tcp-nodelay")
+	}
+
+	conn, _ = serveOne(t, newRedis(settings{tcpNoDelay: false}))
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("TCP_NODELAY is on with -tcp-nodelay=false")
+	}
+}